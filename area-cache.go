@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"sync"
+	"time"
+)
+
+// areaCacheTTL defines how long the cached areas are used before they are loaded from the database again.
+// areas are rarely changed, but might be edited directly in the database
+const areaCacheTTL = time.Minute * 5
+
+// areaCache keeps all areas in memory, so listing bookings does not need a database round trip per booking
+type areaCache struct {
+	mu       sync.RWMutex
+	areas    map[string]Area
+	loadedAt time.Time
+}
+
+var cachedAreas = &areaCache{}
+
+// get returns the area with the given id. the cache is reloaded if it is expired or the area is unknown
+func (ac *areaCache) get(ctx context.Context, id string) (Area, bool, error) {
+	ac.mu.RLock()
+	a, ok := ac.areas[id]
+	fresh := time.Since(ac.loadedAt) < areaCacheTTL
+	ac.mu.RUnlock()
+	if ok && fresh {
+		return a, true, nil
+	}
+	if fresh && ac.areas != nil {
+		// the cache is up to date, so the area does not exist
+		return Area{}, false, nil
+	}
+	if err := ac.reload(ctx); err != nil {
+		return Area{}, false, err
+	}
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	a, ok = ac.areas[id]
+	return a, ok, nil
+}
+
+// reload fetches all areas from the database in a single query
+func (ac *areaCache) reload(ctx context.Context) error {
+	logrus.Debug("loading areas into cache")
+	cur, err := client.Database("office_checkin").Collection("areas").Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	areas := make(map[string]Area)
+	for cur.Next(ctx) {
+		a := Area{}
+		if err := cur.Decode(&a); err != nil {
+			logrus.Warn(err)
+			continue
+		}
+		a.ID = cur.Current.Lookup("_id").ObjectID().Hex()
+		areas[a.ID] = a
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	ac.mu.Lock()
+	ac.areas = areas
+	ac.loadedAt = time.Now()
+	ac.mu.Unlock()
+	return nil
+}
+
+// invalidate forces the next lookup to load the areas from the database again
+func (ac *areaCache) invalidate() {
+	ac.mu.Lock()
+	ac.areas = nil
+	ac.loadedAt = time.Time{}
+	ac.mu.Unlock()
+}
+
+// hasLocation reports whether at least one area belongs to the location
+func (ac *areaCache) hasLocation(ctx context.Context, location string) (bool, error) {
+	ac.mu.RLock()
+	fresh := ac.areas != nil && time.Since(ac.loadedAt) < areaCacheTTL
+	ac.mu.RUnlock()
+	if !fresh {
+		if err := ac.reload(ctx); err != nil {
+			return false, err
+		}
+	}
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	for _, a := range ac.areas {
+		if a.Location == location {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// locations returns the distinct locations of all areas
+func (ac *areaCache) locations(ctx context.Context) ([]string, error) {
+	ac.mu.RLock()
+	fresh := ac.areas != nil && time.Since(ac.loadedAt) < areaCacheTTL
+	ac.mu.RUnlock()
+	if !fresh {
+		if err := ac.reload(ctx); err != nil {
+			return nil, err
+		}
+	}
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	seen := make(map[string]bool)
+	res := []string{}
+	for _, a := range ac.areas {
+		if a.Location != "" && !seen[a.Location] {
+			seen[a.Location] = true
+			res = append(res, a.Location)
+		}
+	}
+	return res, nil
+}
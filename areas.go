@@ -12,17 +12,45 @@ import (
 	"time"
 )
 
+// areaSortFields maps the sort query parameter of the area list endpoint to the document fields
+var areaSortFields = map[string]string{
+	"name":     "name",
+	"capacity": "capacity",
+	"location": "location",
+	"type":     "type",
+}
+
 func getAreas(c *gin.Context) {
 
 	logrus.Debug("Fetching all areas")
+	lo, errs := parseListOptions(c, areaSortFields, "name")
+	if abortWithListErrors(c, errs) {
+		return
+	}
 	filter := bson.D{}
-	cur, err := client.Database("office_checkin").Collection("areas").Find(context.Background(), filter, nil)
+	if l := c.Query("location"); l != "" {
+		filter = append(filter, bson.E{"location", l})
+	}
+	if t := c.Query("type"); t != "" {
+		filter = append(filter, bson.E{"type", t})
+	}
+	var total int64
+	if lo.Envelope {
+		var err error
+		total, err = client.Database("office_checkin").Collection("areas").CountDocuments(context.Background(), filter)
+		if err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+	}
+	cur, err := client.Database("office_checkin").Collection("areas").Find(context.Background(), filter, lo.findOptions())
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
-	var areas []Area
+	areas := []Area{}
 
 	defer cur.Close(context.Background())
 	for cur.Next(context.Background()) {
@@ -34,6 +62,10 @@ func getAreas(c *gin.Context) {
 		area.ID = cur.Current.Lookup("_id").ObjectID().Hex()
 		areas = append(areas, area)
 	}
+	if lo.Envelope {
+		c.JSON(http.StatusOK, Page{Items: areas, NextCursor: lo.nextCursor(len(areas), total), Total: total})
+		return
+	}
 	c.JSON(http.StatusOK, Areas{Areas: areas})
 }
 
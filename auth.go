@@ -66,6 +66,9 @@ func authMiddleware () gin.HandlerFunc {
 			c.Set("isAdmin", true)
 		}
 
+		// location managers may always work at the reception
+		c.Set("isReception", adminUsers[user.Email] || receptionUsers[user.Email])
+
 		c.Set("userMail", user.Email)
 		c.Set("userDisplayName", user.DisplayName)
 		c.Set("userRecord", user)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// BookingStatistic is the number of bookings of an area on a single day. it does not contain any data of the
+// users, so it can be kept after the bookings themselves have been deleted
+type BookingStatistic struct {
+	Area     string `bson:"area" json:"area"`
+	Date     string `bson:"date" json:"date"`
+	Bookings int    `bson:"bookings" json:"bookings"`
+	// Name, Location and Capacity are copied from the area at the time of the bookings
+	Name       string    `bson:"name" json:"name"`
+	Location   string    `bson:"location" json:"location"`
+	Capacity   int       `bson:"capacity" json:"capacity"`
+	Weekday    string    `bson:"weekday" json:"weekday"`
+	ArchivedAt time.Time `bson:"archived_at" json:"archived_at,omitempty"`
+}
+
+// aggregateBookings counts the bookings matching the filter per area and day
+func aggregateBookings(ctx context.Context, filter bson.D) ([]BookingStatistic, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"area", "$area"}, {"date", "$date"}}},
+			{"bookings", bson.D{{"$sum", 1}}},
+			{"name", bson.D{{"$first", "$areadata.name"}}},
+			{"location", bson.D{{"$first", "$areadata.location"}}},
+			{"capacity", bson.D{{"$first", "$areadata.capacity"}}},
+		}}},
+	}
+	cur, err := client.Database("office_checkin").Collection("bookings").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Key struct {
+			Area string `bson:"area"`
+			Date string `bson:"date"`
+		} `bson:"_id"`
+		Bookings int    `bson:"bookings"`
+		Name     string `bson:"name"`
+		Location string `bson:"location"`
+		Capacity int    `bson:"capacity"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	stats := make([]BookingStatistic, 0, len(groups))
+	for _, g := range groups {
+		s := BookingStatistic{
+			Area:     g.Key.Area,
+			Date:     g.Key.Date,
+			Bookings: g.Bookings,
+			Name:     g.Name,
+			Location: g.Location,
+			Capacity: g.Capacity,
+		}
+		// old bookings may not contain a copy of their area
+		if s.Name == "" {
+			if a, ok, err := cachedAreas.get(ctx, s.Area); err == nil && ok {
+				s.Name, s.Location, s.Capacity = a.Name, a.Location, int(a.Capacity)
+			}
+		}
+		if d, err := time.Parse("2006-01-02", s.Date); err == nil {
+			s.Weekday = d.Weekday().String()
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// archiveBookings stores the number of bookings per area and day of all bookings matching the filter in
+// the booking_statistics collection. bookings of past days cannot change anymore, so archiving the same
+// day twice, e.g. after the deletion failed, keeps the higher count instead of adding both
+func archiveBookings(ctx context.Context, filter bson.D) (int, error) {
+	stats, err := aggregateBookings(ctx, filter)
+	if err != nil || len(stats) == 0 {
+		return 0, err
+	}
+	now := time.Now()
+	models := make([]mongo.WriteModel, 0, len(stats))
+	for _, s := range stats {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"area", s.Area}, {"date", s.Date}}).
+			SetUpdate(bson.M{
+				"$max": bson.M{"bookings": s.Bookings},
+				"$set": bson.M{
+					"name":        s.Name,
+					"location":    s.Location,
+					"capacity":    s.Capacity,
+					"weekday":     s.Weekday,
+					"archived_at": now,
+				},
+			}).
+			SetUpsert(true))
+	}
+	if _, err := client.Database("office_checkin").Collection("booking_statistics").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+	return len(stats), nil
+}
+
+// getBookingStatistics returns the bookings per area and day between from and to. archived days and days
+// whose bookings still exist are combined, so the statistics cover the whole range
+func getBookingStatistics(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	from := c.Query("from")
+	to := c.DefaultQuery("to", time.Now().Format("2006-01-02"))
+	_, errFrom := time.Parse("2006-01-02", from)
+	_, errTo := time.Parse("2006-01-02", to)
+	if errFrom != nil || errTo != nil || from > to {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"from and to must be yyyy-mm-dd dates and from must not be after to"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	f := bson.D{{"date", bson.D{{"$gte", from}, {"$lte", to}}}}
+	location := c.Query("location")
+
+	cur, err := client.Database("office_checkin").Collection("booking_statistics").Find(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	var archived []BookingStatistic
+	if err := cur.All(ctx, &archived); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	current, err := aggregateBookings(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+
+	merged := make(map[string]BookingStatistic)
+	for _, s := range append(archived, current...) {
+		k := s.Area + "/" + s.Date
+		if e, ok := merged[k]; ok && e.Bookings >= s.Bookings {
+			continue
+		}
+		merged[k] = s
+	}
+	stats := []BookingStatistic{}
+	for _, s := range merged {
+		if location == "" || s.Location == location {
+			stats = append(stats, s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Date != stats[j].Date {
+			return stats[i].Date < stats[j].Date
+		}
+		return stats[i].Area < stats[j].Area
+	})
+	c.JSON(http.StatusOK, stats)
+}
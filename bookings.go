@@ -139,12 +139,16 @@ func addBooking(c *gin.Context) {
 			booking.UserName = fmt.Sprintf("%v", un)
 			aid, _ := primitive.ObjectIDFromHex(booking.Area)
 			err = client.Database("office_checkin").Collection("areas").FindOne(ctx, bson.D{{"_id", aid}}).Decode(&booking.AreaData)
-			_, err = client.Database("office_checkin").Collection("bookings").InsertOne(ctx, booking)
+			ir, err := client.Database("office_checkin").Collection("bookings").InsertOne(ctx, booking)
 			if err != nil {
 				logrus.Error(err)
 				c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 				return
 			}
+			if oid, ok := ir.InsertedID.(primitive.ObjectID); ok {
+				booking.ID = oid.Hex()
+			}
+			events.publish(Event{Type: EventBookingCreated, Area: booking.Area, Date: booking.Date, Data: booking})
 
 		}
 		if err != nil && err != mongo.ErrNoDocuments {
@@ -159,35 +163,73 @@ func addBooking(c *gin.Context) {
 	c.JSON(http.StatusOK, nil)
 }
 
+// bookingSortFields maps the sort query parameter of the booking list endpoints to the document fields
+var bookingSortFields = map[string]string{
+	"date":      "date",
+	"area":      "area",
+	"user_name": "username",
+}
+
 func getBookings(c *gin.Context) {
 	ufc, _ := c.Get("userId")
 	uid := fmt.Sprintf("%v", ufc)
-	filter := bson.D{{"user", uid}}
-	cur, err := client.Database("office_checkin").Collection("bookings").Find(context.Background(), filter, nil)
+	lo, errs := parseListOptions(c, bookingSortFields, "date")
+	filter, ferrs := parseListFilter(c, true, "", false)
+	if abortWithListErrors(c, append(errs, ferrs...)) {
+		return
+	}
+	filter = append(filter, bson.E{"user", uid})
+	bookings, total, err := findBookings(filter, lo)
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
-	var bookings []Booking
-	defer cur.Close(context.Background())
-	for cur.Next(context.Background()) {
+	if lo.Envelope {
+		c.JSON(http.StatusOK, Page{Items: bookings, NextCursor: lo.nextCursor(len(bookings), total), Total: total})
+		return
+	}
+	c.JSON(http.StatusOK, Bookings{Bookings: bookings})
+}
+
+// findBookings returns the page of bookings matching the filter including their area data.
+// the total number of matching bookings is only counted if the list options ask for an envelope
+func findBookings(filter bson.D, lo listOptions) ([]Booking, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var total int64
+	if lo.Envelope {
+		var err error
+		total, err = client.Database("office_checkin").Collection("bookings").CountDocuments(ctx, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	cur, err := client.Database("office_checkin").Collection("bookings").Find(ctx, filter, lo.findOptions())
+	if err != nil {
+		return nil, 0, err
+	}
+	bookings := []Booking{}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
 		booking := Booking{}
 		err := cur.Decode(&booking)
 		if err != nil {
 			logrus.Error(err)
 		}
 		booking.ID = cur.Current.Lookup("_id").ObjectID().Hex()
-		aid, _ := primitive.ObjectIDFromHex(booking.Area)
-		err = client.Database("office_checkin").Collection("areas").FindOne(context.Background(), bson.D{{"_id", aid}}).Decode(&booking.AreaData)
+		a, ok, err := cachedAreas.get(ctx, booking.Area)
 		if err != nil {
-			logrus.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
-			return
+			return nil, 0, err
+		}
+		if !ok {
+			logrus.WithField("area", booking.Area).Warn("area of booking does not exist anymore")
+		} else {
+			booking.AreaData = a
 		}
 		bookings = append(bookings, booking)
 	}
-	c.JSON(http.StatusOK, Bookings{Bookings: bookings})
+	return bookings, total, cur.Err()
 }
 
 func updateBooking(c *gin.Context) {
@@ -209,13 +251,16 @@ func deleteBooking(c *gin.Context) {
 		return
 	}
 	f := bson.D{{"_id", pbid}, {"user", uid}}
-	r, err := client.Database("office_checkin").Collection("bookings").DeleteOne(context.Background(), f)
-	if err != nil {
+	var b Booking
+	err = client.Database("office_checkin").Collection("bookings").FindOneAndDelete(context.Background(), f).Decode(&b)
+	if err != nil && err != mongo.ErrNoDocuments {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
-	if r.DeletedCount > 0 {
+	if err == nil {
+		b.ID = bid
+		events.publish(Event{Type: EventBookingDeleted, Area: b.Area, Date: b.Date, Data: b})
 		c.JSON(http.StatusOK, SuccessResponse{
 			Code:    http.StatusOK,
 			Message: "successfully deleted booking",
@@ -231,9 +276,12 @@ func deleteBooking(c *gin.Context) {
 
 func adminGetBookings(c *gin.Context) {
 	logrus.Debug("getting all bookings for admin dashboard")
-	var bookings []Booking
-	f := bson.D{}
-	cursor, err := client.Database("office_checkin").Collection("bookings").Find(context.Background(), f)
+	lo, errs := parseListOptions(c, bookingSortFields, "date")
+	f, ferrs := parseListFilter(c, true, "username", false)
+	if abortWithListErrors(c, append(errs, ferrs...)) {
+		return
+	}
+	bookings, total, err := findBookings(f, lo)
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{
@@ -242,17 +290,9 @@ func adminGetBookings(c *gin.Context) {
 		})
 		return
 	}
-	defer cursor.Close(context.Background())
-	for cursor.Next(context.Background()) {
-		booking := Booking{}
-		err := cursor.Decode(&booking)
-		if err != nil {
-			logrus.Error(err)
-		}
-		booking.ID = cursor.Current.Lookup("_id").ObjectID().Hex()
-		aid, _ := primitive.ObjectIDFromHex(booking.Area)
-		err = client.Database("office_checkin").Collection("areas").FindOne(context.Background(), bson.D{{"_id", aid}}).Decode(&booking.AreaData)
-		bookings = append(bookings, booking)
+	if lo.Envelope {
+		c.JSON(http.StatusOK, Page{Items: bookings, NextCursor: lo.nextCursor(len(bookings), total), Total: total})
+		return
 	}
 	c.JSON(http.StatusOK, bookings)
 }
@@ -273,25 +313,12 @@ func adminGetBookingsForDate(c *gin.Context) {
 		return
 	}
 	f := bson.D{{"date", date}}
-	cursor, err := client.Database("office_checkin").Collection("bookings").Find(context.Background(), f)
+	bookings, _, err := findBookings(f, listOptions{})
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
-	var bookings []Booking
-	defer cursor.Close(context.Background())
-	for cursor.Next(context.Background()) {
-		booking := Booking{}
-		err := cursor.Decode(&booking)
-		if err != nil {
-			logrus.Error(err)
-		}
-		booking.ID = cursor.Current.Lookup("_id").ObjectID().Hex()
-		aid, _ := primitive.ObjectIDFromHex(booking.Area)
-		err = client.Database("office_checkin").Collection("areas").FindOne(context.Background(), bson.D{{"_id", aid}}).Decode(&booking.AreaData)
-		bookings = append(bookings, booking)
-	}
 
 	v := getVisitorBookingsForDate(date)
 
@@ -14,7 +14,11 @@ type Config struct {
 		Port        string `yaml:"port", envconfig:"SERVER_PORT"`
 		Environment string `yaml:"environment", envconfig:"SERVER_ENVIRONMENT"`
 		LogLevel    string `yaml:"log_level", envconfig:"SERVER_LOG_LEVEL"`
-		TaskInterval string `yaml:"task_interval", envconfig:"SERVER_TASK_INTERVAL"`
+		// Deprecated: TaskInterval is only read to keep old configs working, use Tasks.Schedules instead
+		TaskInterval string `yaml:"task_interval" envconfig:"SERVER_TASK_INTERVAL"`
+		PublicURL    string `yaml:"public_url" envconfig:"SERVER_PUBLIC_URL"`
+		// TrustedProxies lists the ips or cidr ranges of reverse proxies whose X-Forwarded-For header is used
+		TrustedProxies []string `yaml:"trusted_proxies" envconfig:"SERVER_TRUSTED_PROXIES"`
 	} `yaml:"service"`
 	MongoDB struct {
 		Host       string `yaml:"host", envconfig:"MONGO_HOST"`
@@ -30,6 +34,14 @@ type Config struct {
 		Password string `yaml:"password", envconfig:"EMAIL_PASSWORD"`
 		FromName string `yaml:"from_name", envconfig:"EMAIL_FROM_NAME"`
 		FromMail string `yaml:"from_mail"", envconfig:"EMAIL_FROM_MAIL"`
+		// Transport is smtp, file, log or memory
+		Transport string `yaml:"transport" envconfig:"EMAIL_TRANSPORT"`
+		// Security is starttls, tls or none and only used by the smtp transport
+		Security string `yaml:"security" envconfig:"EMAIL_SECURITY"`
+		// Auth is login, plain or none and only used by the smtp transport
+		Auth string `yaml:"auth" envconfig:"EMAIL_AUTH"`
+		// Directory is the target of the file transport
+		Directory string `yaml:"directory" envconfig:"EMAIL_DIRECTORY"`
 	} `yaml:"email"`
 	Badge struct {
 		BackgroundColor string `yaml:"background_color", envconfig:"BADGE_BG_COLOR"`
@@ -38,13 +50,57 @@ type Config struct {
 	Bookings struct {
 		AutoDelete      bool   `yaml:"auto_delete", envconfig:"BOOKINGS_AUTO_DELETE"`
 		DeleteAfterDays int    `yaml:"delete_after_days", envconfig:"BOOKINGS_DELETE_AFTER_DAYS"`
+		// Archive keeps the number of bookings per area and day in the booking_statistics collection
+		Archive bool `yaml:"archive" envconfig:"BOOKINGS_ARCHIVE"`
 	} `yaml:"bookings"`
+	Notifications struct {
+		// ChatWebhookURL is an incoming webhook of slack or teams receiving short notifications for hosts
+		ChatWebhookURL string `yaml:"chat_webhook_url" envconfig:"NOTIFICATIONS_CHAT_WEBHOOK_URL"`
+		// HostReminderHour is the hour of the day after which hosts receive the list of tomorrow's guests
+		HostReminderHour int `yaml:"host_reminder_hour" envconfig:"NOTIFICATIONS_HOST_REMINDER_HOUR"`
+		// BookingReminders enables the mails reminding employees of their bookings of the next day
+		BookingReminders bool `yaml:"booking_reminders" envconfig:"NOTIFICATIONS_BOOKING_REMINDERS"`
+		// BookingReminderHour is the hour of the day after which employees receive the reminder
+		BookingReminderHour int `yaml:"booking_reminder_hour" envconfig:"NOTIFICATIONS_BOOKING_REMINDER_HOUR"`
+		// GuestReminderDays is the number of days before the visit at which guests who did not answer their
+		// invitation are reminded. 0 disables the reminders
+		GuestReminderDays int `yaml:"guest_reminder_days" envconfig:"NOTIFICATIONS_GUEST_REMINDER_DAYS"`
+	} `yaml:"notifications"`
+	Tasks struct {
+		// Schedules overrides the cron expression of single tasks, e.g. visitor-retention: "0 3 * * *"
+		Schedules map[string]string `yaml:"schedules" ignored:"true"`
+		// LeaseStore is mongodb or memory. memory only works if a single instance of the service is running
+		LeaseStore string `yaml:"lease_store" envconfig:"TASKS_LEASE_STORE"`
+		// LeaseTTL is the time after which the lease of a task expires if its instance stopped renewing it
+		LeaseTTL string `yaml:"lease_ttl" envconfig:"TASKS_LEASE_TTL"`
+	} `yaml:"tasks"`
 	Visitors struct {
 		AutoDelete	    bool   `yaml:"auto_delete", envconfig:"VISITORS_AUTO_DELETE"`
 		DeleteAfterDays	int    `yaml:"delete_after_days", envconfig:"VISITORS_DELETE_AFTER_DAYS"`
+		// Anonymize keeps visits for statistics and only removes the data of the guest instead of deleting them
+		Anonymize bool `yaml:"anonymize" envconfig:"VISITORS_ANONYMIZE"`
+		// DryRun only logs what the retention task would remove
+		DryRun bool `yaml:"dry_run" envconfig:"VISITORS_DRY_RUN"`
+		// DefaultSite is used for visits created without a site. without it the only location of all areas is used
+		DefaultSite string `yaml:"default_site" envconfig:"VISITORS_DEFAULT_SITE"`
+		// Capacity is the number of visits per day allowed at sites without their own capacity. it defaults
+		// to 400 if unset, 0 allows no visits at all
+		Capacity *int `yaml:"capacity" envconfig:"VISITORS_CAPACITY"`
+		// Sites contains the visitor capacity of single sites, the key is the location of the areas
+		Sites map[string]SiteVisitorCapacity `yaml:"sites" ignored:"true"`
 	} `yaml:"visitors"`
 }
 
+// SiteVisitorCapacity defines how many visits per day are allowed at a site. the capacity of a date is taken
+// from Dates, then from Weekdays and finally from Capacity
+type SiteVisitorCapacity struct {
+	Capacity *int `yaml:"capacity"`
+	// Weekdays is keyed by the lowercase english name of the weekday, e.g. saturday
+	Weekdays map[string]int `yaml:"weekdays"`
+	// Dates is keyed by yyyy-mm-dd dates
+	Dates map[string]int `yaml:"dates"`
+}
+
 // loadConfig loads the config from config.yaml and env variables
 func loadConfig(cfg *Config) {
 	parseFile(cfg)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	EventBookingCreated = "booking.created"
+	EventBookingDeleted = "booking.deleted"
+	EventVisitCreated   = "visit.created"
+	EventVisitUpdated   = "visit.updated"
+	EventVisitAccepted  = "visit.accepted"
+	EventVisitDeclined  = "visit.declined"
+	// EventVisitDateProposed is published when the guest asks for a different date
+	EventVisitDateProposed = "visit.date_proposed"
+	// EventVisitCheckedIn and EventVisitCheckedOut are published by the reception
+	EventVisitCheckedIn  = "visit.checked_in"
+	EventVisitCheckedOut = "visit.checked_out"
+)
+
+// Event is published on the event bus whenever something relevant happens inside the service
+type Event struct {
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Area      string      `json:"area,omitempty"`
+	Date      string      `json:"date,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// eventBus distributes events to all subscribers inside this process
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[chan Event]struct{}
+}
+
+var events = &eventBus{subs: make(map[chan Event]struct{})}
+
+// eventTypes contains all events which can be subscribed to from outside the service
+var eventTypes = map[string]bool{
+	EventBookingCreated:    true,
+	EventBookingDeleted:    true,
+	EventVisitCreated:      true,
+	EventVisitUpdated:      true,
+	EventVisitAccepted:     true,
+	EventVisitDeclined:     true,
+	EventVisitDateProposed: true,
+	EventVisitCheckedIn:    true,
+	EventVisitCheckedOut:   true,
+}
+
+// subscribe returns a channel receiving all events published after the subscription
+func (b *eventBus) subscribe(buffer int) chan Event {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes the subscription and closes the channel
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+}
+
+// publish sends the event to all subscribers. slow subscribers do not block the publisher,
+// the event is dropped for them instead
+func (b *eventBus) publish(e Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			logrus.WithField("event", e.Type).Warn("subscriber is too slow. dropping event")
+		}
+	}
+}
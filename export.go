@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportWriter abstracts the output format of an export, so bookings and visits can be written row by row
+// without knowing whether the result is a csv or an xlsx file
+type exportWriter interface {
+	WriteRow(values []string) error
+	Close() error
+}
+
+// csvExportWriter streams the rows directly to the response body
+type csvExportWriter struct {
+	w *csv.Writer
+	c *gin.Context
+	n int
+}
+
+func (e *csvExportWriter) WriteRow(values []string) error {
+	if err := e.w.Write(values); err != nil {
+		return err
+	}
+	// flush the data to the client every now and then, so large exports do not pile up in the buffer
+	e.n++
+	if e.n%500 == 0 {
+		e.w.Flush()
+		e.c.Writer.Flush()
+	}
+	return e.w.Error()
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// xlsxExportWriter uses the excelize stream writer, which keeps only the current rows in memory
+// and writes the rest into a temporary file until the workbook is sent to the client
+type xlsxExportWriter struct {
+	f   *excelize.File
+	sw  *excelize.StreamWriter
+	c   *gin.Context
+	row int
+}
+
+func (e *xlsxExportWriter) WriteRow(values []string) error {
+	e.row++
+	cell, err := excelize.CoordinatesToCellName(1, e.row)
+	if err != nil {
+		return err
+	}
+	r := make([]interface{}, len(values))
+	for i, v := range values {
+		r[i] = v
+	}
+	return e.sw.SetRow(cell, r)
+}
+
+func (e *xlsxExportWriter) Close() error {
+	defer e.f.Close()
+	if err := e.sw.Flush(); err != nil {
+		return err
+	}
+	return e.f.Write(e.c.Writer)
+}
+
+// newExportWriter prepares the response headers and returns a writer for the requested format
+func newExportWriter(c *gin.Context, name, format string) (exportWriter, error) {
+	fileName := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("2006-01-02"), format)
+	switch format {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+		w := csv.NewWriter(c.Writer)
+		w.Comma = ';'
+		return &csvExportWriter{w: w, c: c}, nil
+	case "xlsx":
+		f := excelize.NewFile()
+		sw, err := f.NewStreamWriter("Sheet1")
+		if err != nil {
+			return nil, err
+		}
+		c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+		return &xlsxExportWriter{f: f, sw: sw, c: c}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %s", format)
+}
+
+func exportBookings(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	f, errs := parseListFilter(c, true, "username", false)
+	if abortWithListErrors(c, errs) {
+		return
+	}
+	logrus.WithField("filter", f).Debug("exporting bookings")
+	runExport(c, "bookings", "bookings", f, []string{"id", "date", "user", "user_name", "area", "area_name"}, func(cur *mongo.Cursor) ([]string, error) {
+		b := Booking{}
+		if err := cur.Decode(&b); err != nil {
+			return nil, err
+		}
+		return []string{
+			cur.Current.Lookup("_id").ObjectID().Hex(),
+			b.Date,
+			b.User,
+			b.UserName,
+			b.Area,
+			b.AreaData.Name,
+		}, nil
+	})
+}
+
+func exportVisits(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	f, errs := parseListFilter(c, false, "supervisor.email", true)
+	if abortWithListErrors(c, errs) {
+		return
+	}
+	logrus.WithField("filter", f).Debug("exporting visits")
+	header := []string{"id", "date", "end_date", "group_id", "site", "first_name", "last_name", "email", "company", "supervisor", "supervisor_email", "needs_parking_space", "parking_space", "has_accepted", "checked_in_at", "checked_out_at"}
+	runExport(c, "visits", "visits", f, header, func(cur *mongo.Cursor) ([]string, error) {
+		v := Visit{}
+		if err := cur.Decode(&v); err != nil {
+			return nil, err
+		}
+		return []string{
+			v.ID.Hex(),
+			v.Date,
+			v.lastDate(),
+			groupID(v.GroupID),
+			v.Site,
+			v.Visitor.FirstName,
+			v.Visitor.LastName,
+			v.Visitor.Email,
+			v.Visitor.Company,
+			v.Supervisor.DisplayName,
+			v.Supervisor.Email,
+			fmt.Sprintf("%t", v.NeedsParkingSpace),
+			parkingSpaceName(v.Parking),
+			fmt.Sprintf("%t", v.HasAccepted),
+			formatTimestamp(v.CheckedInAt),
+			formatTimestamp(v.CheckedOutAt),
+		}, nil
+	})
+}
+
+// runExport iterates over the matching documents of the collection and writes every document as a single row.
+// the documents are never loaded into memory at once
+func runExport(c *gin.Context, name, collection string, f bson.D, header []string, row func(cur *mongo.Cursor) ([]string, error)) {
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	if format != "csv" && format != "xlsx" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"format must be csv or xlsx"},
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+	cur, err := client.Database("office_checkin").Collection(collection).Find(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	defer cur.Close(ctx)
+
+	w, err := newExportWriter(c, name, format)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.Status(http.StatusOK)
+	if err := w.WriteRow(header); err != nil {
+		logrus.Error(err)
+		return
+	}
+	for cur.Next(ctx) {
+		r, err := row(cur)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+		if err := w.WriteRow(r); err != nil {
+			// the response has already been started, so there is no way to tell the client anymore
+			logrus.Error(err)
+			return
+		}
+	}
+	if err := cur.Err(); err != nil {
+		logrus.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// formatTimestamp returns the time in RFC 3339 or an empty cell if it is not set
+func formatTimestamp(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parkingSpaceName returns the lot and label of the parking space or an empty cell
+func parkingSpaceName(p *ParkingAssignment) string {
+	if p == nil {
+		return ""
+	}
+	return p.LotName + " " + p.Space
+}
+
+// groupID returns the hex id of the visit group or an empty cell
+func groupID(id *primitive.ObjectID) string {
+	if id == nil {
+		return ""
+	}
+	return id.Hex()
+}
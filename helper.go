@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -34,7 +36,7 @@ func isAreaBookableForDate(area, date string) bool {
 }
 
 func getVisitorBookingsForDate(date string) []Visit {
-	f := bson.D{{"date", date}}
+	f := visitOnDateFilter(date)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
 	defer cancel()
 	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
@@ -56,14 +58,11 @@ func getVisitorBookingsForDate(date string) []Visit {
 	return visits
 }
 
-func isDateBookableForVisitor(date string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
-	defer cancel()
-	f := bson.D{{"date", date}}
-	c, err := client.Database("office_checkin").Collection("visits").CountDocuments(ctx, f)
-	if err != nil {
-		logrus.Error(err)
-		return false
+// randomToken returns a hex encoded cryptographically secure random token of n bytes
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return c < 400 // Actually reduce number of bookings allowed per day, but for now let it stick at 400
-}
\ No newline at end of file
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultLocale is used whenever no translation for the requested locale exists
+const defaultLocale = "de"
+
+// translations contains the catalogs of all supported locales. api error messages are written in english,
+// so their english translation is the message itself and the message is used as key
+var translations = map[string]map[string]string{
+	"de": {
+		"date.format": "02.01.2006",
+
+		"mail.invitation.subject":          "Anmeldung als Gast bei der cronos Unternehmensberatung",
+		"mail.visit-cancellation.subject":  "Ihr Besuch am {{.Date}} wurde abgesagt",
+		"mail.invitation-response.subject": "{{.Guest}} hat auf Ihre Einladung für den {{.Date}} geantwortet",
+		"mail.visit-update.subject":        "Ihr Besuch wurde auf den {{.Date}} verschoben",
+		"mail.visitor-arrived.subject":     "{{.Guest}} ist eingetroffen",
+		"mail.host-visit-reminder.subject": "Ihre Gäste am {{.Date}}",
+		"mail.invitation-reminder.subject": "Erinnerung: Ihr Besuch am {{.Date}}",
+		"mail.booking-reminder.subject":    "Erinnerung: Ihre Buchung am {{.Date}}",
+
+		"invitation.status.accepted":      "hat die Einladung angenommen",
+		"invitation.status.declined":      "hat die Einladung abgelehnt",
+		"invitation.status.date_proposed": "bittet um einen anderen Termin",
+
+		"chat.visitor_arrived": "%s ist eingetroffen (%s)",
+
+		"badge.supervisor": "Ansprechpartner: ",
+		"badge.valid_on":   "Gültig am: ",
+		"badge.parking":    "Parkplatz: ",
+		"badge.notice":     "Dieses Badge muss jederzeit gut sichtbar getragen werden.",
+
+		"record.title":         "Nachweis der Gästeregistrierung",
+		"record.visit":         "Besuch: ",
+		"record.date":          "Datum: ",
+		"record.site":          "Standort: ",
+		"record.supervisor":    "Ansprechpartner: ",
+		"record.guest":         "Gast: ",
+		"record.company":       "Unternehmen: ",
+		"record.phone":         "Telefon: ",
+		"record.license_plate": "Kennzeichen: ",
+		"record.registered_at": "Registriert am: ",
+		"record.documents":     "Akzeptierte Dokumente",
+		"record.no_documents":  "Keine",
+		"record.document":      "%s (%s, Version %d, Sprache %s)",
+		"record.accepted":      "Akzeptiert am %s von %s",
+		"record.browser":       "Browser: ",
+		"record.time.format":   "02.01.2006 15:04:05 MST",
+
+		"ical.visit.summary":    "Besuch bei der cronos Unternehmensberatung",
+		"ical.visit.supervisor": "Ansprechpartner: ",
+		"ical.booking.summary":  "Büro: ",
+		"ical.host.summary":     "Besuch: ",
+
+		"visit id malformed":                                                        "Die Besuchs-ID ist ungültig",
+		"the visit could not be found":                                              "Der Besuch konnte nicht gefunden werden",
+		"body malformed":                                                            "Die Anfrage ist fehlerhaft",
+		ErrorInternalError.Errors[0]:                                                "Interner Serverfehler. Bitte wenden Sie sich an Ihren Administrator",
+		ErrorForbidden.Errors[0]:                                                    "Sie sind nicht berechtigt, diese Anfrage auszuführen",
+		ErrorTokenInvalidOrNotFound.Errors[0]:                                       "Das Token ist ungültig oder fehlt in Ihrer Anfrage",
+		ErrorNotImplemented.Errors[0]:                                               "Dieser Endpunkt ist noch nicht implementiert",
+		"date malformed. must be yyyy-mm-dd":                                        "Das Datum ist ungültig. Es muss im Format JJJJ-MM-TT angegeben werden",
+		"the invitation is invalid or expired":                                      "Die Einladung ist ungültig oder abgelaufen",
+		"too many requests. please try again later":                                 "Zu viele Anfragen. Bitte versuchen Sie es später erneut",
+		"status must be accepted, declined or date_proposed":                        "Der Status muss accepted, declined oder date_proposed sein",
+		"the proposed date must not be in the past":                                 "Der vorgeschlagene Termin darf nicht in der Vergangenheit liegen",
+		"the message must not be longer than 1000 characters":                       "Die Nachricht darf nicht länger als 1000 Zeichen sein",
+		"phone cannot be empty":                                                     "Die Telefonnummer darf nicht leer sein",
+		"license plate cannot be empty if a parking space is needed":                "Für einen Parkplatz wird das Kennzeichen benötigt",
+		"license plate malformed":                                                   "Das Kennzeichen ist ungültig",
+		"a document has changed. please read it again":                              "Ein Dokument wurde geändert. Bitte lesen Sie es erneut",
+		"all required documents have to be accepted":                                "Alle erforderlichen Dokumente müssen akzeptiert werden",
+		"the booking does not exist anymore or the link has expired":                "Die Buchung existiert nicht mehr oder der Link ist abgelaufen",
+		"please complete the registration before accepting the invitation":          "Bitte schließen Sie die Registrierung ab, bevor Sie die Einladung annehmen",
+		"the date is fully booked. please ask your contact person for another date": "Der Termin ist ausgebucht. Bitte vereinbaren Sie mit Ihrem Ansprechpartner einen anderen Termin",
+		"there is no parking space left on the date. please ask your contact person for another date": "An diesem Termin ist kein Parkplatz mehr frei. Bitte vereinbaren Sie mit Ihrem Ansprechpartner einen anderen Termin",
+	},
+	"en": {
+		"date.format": "2 January 2006",
+
+		"mail.invitation.subject":          "Your visit to cronos Unternehmensberatung",
+		"mail.visit-cancellation.subject":  "Your visit on {{.Date}} has been cancelled",
+		"mail.invitation-response.subject": "{{.Guest}} answered your invitation for {{.Date}}",
+		"mail.visit-update.subject":        "Your visit has been moved to {{.Date}}",
+		"mail.visitor-arrived.subject":     "{{.Guest}} has arrived",
+		"mail.host-visit-reminder.subject": "Your guests on {{.Date}}",
+		"mail.invitation-reminder.subject": "Reminder: Your visit on {{.Date}}",
+		"mail.booking-reminder.subject":    "Reminder: Your booking on {{.Date}}",
+
+		"invitation.status.accepted":      "accepted the invitation",
+		"invitation.status.declined":      "declined the invitation",
+		"invitation.status.date_proposed": "asks for a different date",
+
+		"chat.visitor_arrived": "%s has arrived (%s)",
+
+		"badge.supervisor": "Contact: ",
+		"badge.valid_on":   "Valid on: ",
+		"badge.parking":    "Parking: ",
+		"badge.notice":     "This badge must be worn visibly at all times.",
+
+		"record.title":         "Record of the guest registration",
+		"record.visit":         "Visit: ",
+		"record.date":          "Date: ",
+		"record.site":          "Site: ",
+		"record.supervisor":    "Contact: ",
+		"record.guest":         "Guest: ",
+		"record.company":       "Company: ",
+		"record.phone":         "Phone: ",
+		"record.license_plate": "License plate: ",
+		"record.registered_at": "Registered on: ",
+		"record.documents":     "Accepted documents",
+		"record.no_documents":  "None",
+		"record.document":      "%s (%s, version %d, language %s)",
+		"record.accepted":      "Accepted on %s from %s",
+		"record.browser":       "Browser: ",
+		"record.time.format":   "2006-01-02 15:04:05 MST",
+
+		"ical.visit.summary":    "Visit to cronos Unternehmensberatung",
+		"ical.visit.supervisor": "Contact: ",
+		"ical.booking.summary":  "Office: ",
+		"ical.host.summary":     "Visit: ",
+	},
+}
+
+// normalizeLocale turns values like "en_US" or "EN-us" into "en-us"
+func normalizeLocale(l string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(l), "_", "-"))
+}
+
+// localeChain returns the locales to look up in order, e.g. de-at, de and the default locale
+func localeChain(l string) []string {
+	l = normalizeLocale(l)
+	chain := []string{}
+	for l != "" {
+		chain = append(chain, l)
+		i := strings.LastIndex(l, "-")
+		if i < 0 {
+			break
+		}
+		l = l[:i]
+	}
+	return append(chain, defaultLocale)
+}
+
+// isSupportedLocale reports whether there is a catalog for the locale or one of its parents
+func isSupportedLocale(l string) bool {
+	chain := localeChain(l)
+	for _, cl := range chain[:len(chain)-1] {
+		if _, ok := translations[cl]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// translate looks up the key in the catalogs of the locale chain. if no catalog contains the key,
+// the key itself is returned
+func translate(locale, key string) string {
+	for _, l := range localeChain(locale) {
+		if t, ok := translations[l][key]; ok {
+			return t
+		}
+	}
+	return key
+}
+
+// formatDate formats a yyyy-mm-dd date according to the locale
+func formatDate(locale, date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	return t.Format(translate(locale, "date.format"))
+}
+
+// localizedTemplate returns the path of the mail template file for the locale. translated templates are stored
+// in a sub directory named after the locale, the templates of the default locale directly in mail-templates
+func localizedTemplate(locale, file string) string {
+	for _, l := range localeChain(locale) {
+		if l == defaultLocale {
+			break
+		}
+		p := filepath.Join("mail-templates", l, file)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join("mail-templates", file)
+}
+
+// requestLocale reads the preferred locale of the client from the Accept-Language header
+func requestLocale(c *gin.Context) string {
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		l := strings.TrimSpace(strings.Split(part, ";")[0])
+		if l != "" && l != "*" {
+			return l
+		}
+	}
+	return ""
+}
+
+// localizeErrors translates the messages of an error response into the language of the client.
+// english is the language of the messages, so it is used if the client does not ask for anything else
+func localizeErrors(c *gin.Context, e ErrorResponse) ErrorResponse {
+	l := requestLocale(c)
+	if l == "" {
+		return e
+	}
+	// the default locale is not used as fallback here, because the messages are already english
+	chain := localeChain(l)
+	chain = chain[:len(chain)-1]
+	res := ErrorResponse{Code: e.Code, Errors: make([]string, len(e.Errors))}
+	for i, m := range e.Errors {
+		res.Errors[i] = m
+		for _, cl := range chain {
+			if t, ok := translations[cl][m]; ok {
+				res.Errors[i] = t
+				break
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// calendarEvent is a single all day event in an iCalendar document
+type calendarEvent struct {
+	UID         string
+	Date        string
+	EndDate     string // last day of events spanning several days, may be empty
+	Summary     string
+	Location    string
+	Description string
+}
+
+// icsEscaper escapes text values according to RFC 5545
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line and folds it after 75 octets as required by RFC 5545
+func writeICSLine(b *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// never split a multi byte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space, which counts towards the limit
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// renderICS creates an iCalendar document containing all day events. method is the iCalendar METHOD property
+func renderICS(name, method string, events []calendarEvent) []byte {
+	var b bytes.Buffer
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//cronos//office-checkin-backend//DE")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:"+method)
+	if name != "" {
+		writeICSLine(&b, "X-WR-CALNAME:"+icsEscaper.Replace(name))
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		start, err := time.Parse("2006-01-02", e.Date)
+		if err != nil {
+			logrus.WithField("date", e.Date).Warn("skipping calendar event with invalid date")
+			continue
+		}
+		end := start
+		if e.EndDate != "" {
+			if end, err = time.Parse("2006-01-02", e.EndDate); err != nil || end.Before(start) {
+				end = start
+			}
+		}
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:"+e.UID)
+		writeICSLine(&b, "DTSTAMP:"+stamp)
+		writeICSLine(&b, "DTSTART;VALUE=DATE:"+start.Format("20060102"))
+		writeICSLine(&b, "DTEND;VALUE=DATE:"+end.AddDate(0, 0, 1).Format("20060102"))
+		writeICSLine(&b, "SUMMARY:"+icsEscaper.Replace(e.Summary))
+		if e.Location != "" {
+			writeICSLine(&b, "LOCATION:"+icsEscaper.Replace(e.Location))
+		}
+		if e.Description != "" {
+			writeICSLine(&b, "DESCRIPTION:"+icsEscaper.Replace(e.Description))
+		}
+		writeICSLine(&b, "TRANSP:TRANSPARENT")
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.Bytes()
+}
+
+// visitICS creates the calendar attachment for the invitation mail of a guest
+func visitICS(v Visit) []byte {
+	return renderICS("", "PUBLISH", []calendarEvent{{
+		UID:         "visit-" + v.ID.Hex() + "@office-checkin",
+		Date:        v.Date,
+		EndDate:     v.lastDate(),
+		Summary:     translate(v.Visitor.Locale, "ical.visit.summary"),
+		Description: translate(v.Visitor.Locale, "ical.visit.supervisor") + v.Supervisor.DisplayName + " <" + v.Supervisor.Email + ">",
+	}})
+}
+
+// calendarLookups limits the feed requests per client, so tokens cannot be guessed
+var calendarLookups = newRateLimiter(30, time.Minute)
+
+// getCalendarToken tells the user whether a personal iCal feed exists. the token is only stored as hash, so
+// the url cannot be shown again. it is only returned once when the feed is created by rotateCalendarToken
+func getCalendarToken(c *gin.Context) {
+	u, err := getSingleUser(c.GetString("userId"))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"you have to create your user profile first"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Active bool `json:"active"`
+	}{
+		Active: u.CalendarTokenHash != "",
+	})
+}
+
+// rotateCalendarToken creates the personal iCal feed and returns its url. an existing url is invalidated,
+// e.g. if it has been shared accidentally
+func rotateCalendarToken(c *gin.Context) {
+	token, err := setCalendarToken(c.GetString("userId"))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"you have to create your user profile first"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, calendarFeedResponse(token))
+}
+
+func setCalendarToken(firebaseID string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	update := bson.M{"$set": bson.M{"calendartokenhash": hashToken(token)}}
+	r, err := client.Database("office_checkin").Collection("users").UpdateOne(ctx, bson.D{{"firebaseid", firebaseID}}, update)
+	if err != nil {
+		return "", err
+	}
+	if r.MatchedCount == 0 {
+		return "", mongo.ErrNoDocuments
+	}
+	return token, nil
+}
+
+// migrateCalendarTokens replaces the plaintext calendar tokens stored before the tokens were hashed. the urls
+// of existing feeds stay valid
+func migrateCalendarTokens() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	coll := client.Database("office_checkin").Collection("users")
+	cur, err := coll.Find(ctx, bson.D{{"calendartoken", bson.D{{"$exists", true}}}}, options.Find().SetProjection(bson.M{"_id": 1, "calendartoken": 1}))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	var users []struct {
+		ID            primitive.ObjectID `bson:"_id"`
+		CalendarToken string             `bson:"calendartoken"`
+	}
+	if err := cur.All(ctx, &users); err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, u := range users {
+		set := bson.M{}
+		if u.CalendarToken != "" {
+			set["calendartokenhash"] = hashToken(u.CalendarToken)
+		}
+		update := bson.M{"$unset": bson.M{"calendartoken": ""}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if _, err := coll.UpdateOne(ctx, bson.D{{"_id", u.ID}}, update); err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+	if len(users) > 0 {
+		logrus.WithField("users", len(users)).Info("replaced the calendar tokens of users by their hash")
+	}
+}
+
+func calendarFeedResponse(token string) interface{} {
+	path := "/v1/calendar/" + token + ".ics"
+	return struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}{
+		Token: token,
+		URL:   strings.TrimSuffix(cfg.Service.PublicURL, "/") + path,
+	}
+}
+
+// getCalendarFeed renders all bookings and hosted visits of the owner of the token. the endpoint is not
+// protected by the auth middleware, because calendar clients cannot send firebase tokens
+func getCalendarFeed(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+	if token == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	var u User
+	err := client.Database("office_checkin").Collection("users").FindOne(ctx, bson.D{{"calendartokenhash", hashToken(token)}}).Decode(&u)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logrus.Error(err)
+		}
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// only show the last few weeks, so the feed does not grow forever
+	since := time.Now().Add(-time.Hour * 24 * 28).Format("2006-01-02")
+	f := bson.D{{"user", u.FirebaseID}, {"date", bson.D{{"$gte", since}}}}
+	opts := options.Find().SetSort(bson.D{{"date", 1}})
+	evs := []calendarEvent{}
+
+	bookings, _, err := findBookings(f, listOptions{Sort: bson.D{{"date", 1}}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	for _, b := range bookings {
+		loc := b.AreaData.Name
+		if b.AreaData.Address != "" {
+			loc += ", " + b.AreaData.Address
+		}
+		evs = append(evs, calendarEvent{
+			UID:      "booking-" + b.ID + "@office-checkin",
+			Date:     b.Date,
+			Summary:  translate(u.Locale, "ical.booking.summary") + b.AreaData.Name,
+			Location: loc,
+		})
+	}
+
+	// guests who declined do not come, so their visits are not shown
+	vf := append(visitOverlapFilter(since, "9999-12-31"),
+		bson.E{"user", u.FirebaseID},
+		bson.E{"invitationstatus", bson.D{{"$ne", InvitationStatusDeclined}}},
+	)
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, vf, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		v := Visit{}
+		if err := cur.Decode(&v); err != nil {
+			logrus.Warn(err)
+			continue
+		}
+		desc := v.AdditionalInfo
+		if v.Visitor.Company != "" {
+			desc = strings.TrimSpace(v.Visitor.Company + "\n" + desc)
+		}
+		evs = append(evs, calendarEvent{
+			UID:         "visit-" + v.ID.Hex() + "@office-checkin",
+			Date:        v.Date,
+			EndDate:     v.lastDate(),
+			Summary:     translate(u.Locale, "ical.host.summary") + v.Visitor.FirstName + " " + v.Visitor.LastName,
+			Description: desc,
+		})
+	}
+
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", renderICS("Office Check-in", "PUBLISH", evs))
+}
@@ -1,76 +1,295 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
-	"errors"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"html/template"
-	"net"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"net/http"
-	"net/mail"
-	"net/smtp"
 	"time"
 )
 
-type loginAuth struct {
-	username, password string
+// invitationGracePeriod defines how long the invitation link stays valid after the last day of the visit
+const invitationGracePeriod = time.Hour * 24
+
+// invitationLookups limits the lookups of invitation tokens per client, so tokens cannot be guessed
+var invitationLookups = newRateLimiter(30, time.Minute)
+
+// newInvitationToken creates a random token for the visit and stores its hash and expiry date on the visit.
+// the returned token is only meant to be sent to the guest
+func newInvitationToken(v *Visit) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	date, err := time.Parse("2006-01-02", v.lastDate())
+	if err != nil {
+		return "", err
+	}
+	v.InvitationToken = hashToken(token)
+	v.InvitationExpiresAt = date.Add(time.Hour*24 + invitationGracePeriod)
+	return token, nil
 }
 
-func LoginAuth(username, password string) smtp.Auth {
-	return &loginAuth{username, password}
+// hashToken returns the hex encoded sha256 hash of the token
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
 }
 
-func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
-	return "LOGIN", []byte(a.username), nil
+// invitationFilter matches the visit of a token as long as the token is not expired
+func invitationFilter(token string) bson.D {
+	return bson.D{
+		{"invitationtoken", hashToken(token)},
+		{"invitationexpiresat", bson.D{{"$gt", time.Now()}}},
+	}
 }
 
-func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
-	if more {
-		switch string(fromServer) {
-		case "Username:":
-			return []byte(a.username), nil
-		case "Password:":
-			return []byte(a.password), nil
-		default:
-			return nil, errors.New("Unknown from server")
-		}
+func findVisitByInvitationToken(ctx context.Context, token string) (v Visit, err error) {
+	if token == "" {
+		return v, mongo.ErrNoDocuments
 	}
-	return nil, nil
+	err = client.Database("office_checkin").Collection("visits").FindOne(ctx, invitationFilter(token)).Decode(&v)
+	return
 }
 
-func acceptInvitation(c *gin.Context) {
-	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+// migrateInvitationTokens keeps the links of invitations sent before the tokens were introduced working.
+// these links contain the id of the visit, so its hash becomes the token of the visit. the link expires
+// like a new one after the last day of the visit
+func migrateInvitationTokens() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	coll := client.Database("office_checkin").Collection("visits")
+	f := bson.D{{"invitationtoken", bson.D{{"$exists", false}}}}
+	cur, err := coll.Find(ctx, f, options.Find().SetProjection(bson.M{"_id": 1, "date": 1, "enddate": 1}))
 	if err != nil {
-		logrus.Info(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
-			Code:   http.StatusBadRequest,
-			Errors: []string{"visit id malformed"},
-		})
+		logrus.Error(err)
 		return
 	}
+	var visits []Visit
+	if err := cur.All(ctx, &visits); err != nil {
+		logrus.Error(err)
+		return
+	}
+	n := 0
+	for _, v := range visits {
+		date, err := time.Parse("2006-01-02", v.lastDate())
+		if err != nil {
+			logrus.WithField("visit", v.ID.Hex()).Warn(err)
+			continue
+		}
+		update := bson.M{"$set": bson.M{
+			"invitationtoken":     hashToken(v.ID.Hex()),
+			"invitationexpiresat": date.Add(time.Hour*24 + invitationGracePeriod),
+		}}
+		if _, err := coll.UpdateOne(ctx, append(f, bson.E{"_id", v.ID}), update); err != nil {
+			logrus.Error(err)
+			return
+		}
+		n++
+	}
+	if n > 0 {
+		logrus.WithField("visits", n).Info("created invitation tokens for visits invited before tokens were introduced")
+	}
+}
+
+// InvitationResponse is sent by the guest to answer the invitation
+type InvitationResponse struct {
+	Status       string `json:"status"`
+	Message      string `json:"message"`
+	ProposedDate string `json:"proposed_date"`
+}
+
+// InvitationStatusChange records a single answer of the guest on the visit
+type InvitationStatusChange struct {
+	Status       string    `json:"status"`
+	Message      string    `json:"message,omitempty"`
+	ProposedDate string    `json:"proposed_date,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const (
+	InvitationStatusPending      = "pending"
+	InvitationStatusAccepted     = "accepted"
+	InvitationStatusDeclined     = "declined"
+	InvitationStatusDateProposed = "date_proposed"
+)
 
+// invitationEvents maps the answers of the guest to the published events
+var invitationEvents = map[string]string{
+	InvitationStatusAccepted:     EventVisitAccepted,
+	InvitationStatusDeclined:     EventVisitDeclined,
+	InvitationStatusDateProposed: EventVisitDateProposed,
+}
+
+// acceptInvitation stores the answer of the guest. without a body the invitation is accepted.
+// the id parameter is the invitation token from the mail
+func acceptInvitation(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 
 	defer cancel()
 
-	f := bson.D{{"_id", oid}}
+	token := c.Param("id")
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the invitation is invalid or expired"},
+		}))
+		return
+	}
+
+	r := InvitationResponse{Status: InvitationStatusAccepted}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&r); err != nil {
+			logrus.Info(err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusBadRequest,
+				Errors: []string{"body malformed"},
+			}))
+			return
+		}
+	}
+	errs := []string{}
+	if _, ok := invitationEvents[r.Status]; !ok {
+		errs = append(errs, "status must be accepted, declined or date_proposed")
+	}
+	if r.Status == InvitationStatusDateProposed {
+		if d, err := time.Parse("2006-01-02", r.ProposedDate); err != nil {
+			errs = append(errs, "date malformed. must be yyyy-mm-dd")
+		} else if d.Before(time.Now().Truncate(time.Hour * 24)) {
+			errs = append(errs, "the proposed date must not be in the past")
+		}
+	} else {
+		r.ProposedDate = ""
+	}
+	if len(r.Message) > 1000 {
+		errs = append(errs, "the message must not be longer than 1000 characters")
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, localizeErrors(c, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		}))
+		return
+	}
+
+	current, err := findVisitByInvitationToken(ctx, token)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	if r.Status == InvitationStatusAccepted {
+		missing, err := registrationMissing(ctx, current)
+		if err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+			return
+		}
+		if missing {
+			c.AbortWithStatusJSON(http.StatusConflict, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusConflict,
+				Errors: []string{"please complete the registration before accepting the invitation"},
+			}))
+			return
+		}
+	}
+
+	set := bson.M{
+		"hasaccepted":      r.Status == InvitationStatusAccepted,
+		"invitationstatus": r.Status,
+	}
+	// a declined visit neither counts against the capacity nor keeps its parking space, so both have to be
+	// available again if the guest changes their mind
+	var parking *ParkingAssignment
+	reactivated := current.InvitationStatus == InvitationStatusDeclined && r.Status != InvitationStatusDeclined
+	if reactivated {
+		ok, _, _, err := reserveVisitorCapacity(ctx, current.Site, current.dates(), 1)
+		if err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusConflict, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusConflict,
+				Errors: []string{"the date is fully booked. please ask your contact person for another date"},
+			}))
+			return
+		}
+		if current.NeedsParkingSpace && current.Parking == nil {
+			if err := assignVisitorParking(ctx, &current); err != nil {
+				releaseVisitorCapacity(ctx, current.Site, current.dates(), 1)
+				if err == errNoParkingSpace {
+					c.AbortWithStatusJSON(http.StatusConflict, localizeErrors(c, ErrorResponse{
+						Code:   http.StatusConflict,
+						Errors: []string{"there is no parking space left on the date. please ask your contact person for another date"},
+					}))
+					return
+				}
+				logrus.Error(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+				return
+			}
+			parking = current.Parking
+			set["parking"] = parking
+		}
+	}
+
 	update := bson.M{
-		"$set": struct {
-			HasAccepted bool
-		}{HasAccepted: true},
+		"$set": set,
+		"$push": bson.M{
+			"invitationhistory": InvitationStatusChange{
+				Status:       r.Status,
+				Message:      r.Message,
+				ProposedDate: r.ProposedDate,
+				CreatedAt:    time.Now(),
+			},
+		},
 	}
-	if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, f, update); err != nil {
+	// a guest who does not come does not need the parking space anymore
+	if r.Status == InvitationStatusDeclined && current.Parking != nil {
+		update["$unset"] = bson.M{"parking": ""}
+	}
+	var visit Visit
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = client.Database("office_checkin").Collection("visits").FindOneAndUpdate(ctx, invitationFilter(token), update, opts).Decode(&visit)
+	if err != nil {
+		if reactivated {
+			releaseVisitorCapacity(ctx, current.Site, current.dates(), 1)
+			releaseParking(ctx, parking)
+		}
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
+			return
+		}
 		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, ErrorInternalError)
+		c.JSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
 		return
 	}
+	if r.Status == InvitationStatusDeclined && current.InvitationStatus != InvitationStatusDeclined {
+		releaseVisitCapacity(ctx, current)
+		releaseParking(ctx, current.Parking)
+	}
+	events.publish(Event{Type: invitationEvents[r.Status], Date: visit.Date, Data: visit})
+	if err := notifyHostAboutResponse(visit, r); err != nil {
+		logrus.Error(err)
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -89,7 +308,11 @@ func resendMail(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
+	// resending rotates the token, so only the host and admins may revoke the link of the guest
 	f := bson.D{{"_id", oid}}
+	if !c.GetBool("isAdmin") {
+		f = append(f, bson.E{"user", c.GetString("userId")})
+	}
 
 	visit := Visit{}
 
@@ -107,90 +330,87 @@ func resendMail(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		date, _ := time.Parse("2006-01-02", visit.Date)
-		if err := sendMail(visit.Visitor.Email, visit.ID.Hex(), visit.Visitor.FirstName+" "+visit.Visitor.LastName, date.Format("02.01.2006")); err != nil {
-			logrus.Error(err)
-		}
-	}()
-	c.Status(http.StatusOK)
-}
-
-func sendMail(address, visitID, name, date string) error {
-	logrus.Debug("trying to send mail")
-	from := mail.Address{cfg.Email.FromName, cfg.Email.FromMail}
-	password := cfg.Email.Password
-	to := mail.Address{name, address}
-	smtpHost := fmt.Sprintf("%s:%s", cfg.Email.Host, cfg.Email.Port)
-	mimeHeaders := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\nFrom: " + cfg.Email.FromName + " <" + cfg.Email.FromMail + ">\n\n"
-
-	var body bytes.Buffer
-
-	body.Write([]byte(fmt.Sprintf("Subject: Anmeldung als Gast bei der cronos Unternehmensberatung \n%s\n\n", mimeHeaders)))
-
-	t, err := template.ParseFiles("mail-templates/invitation.html")
-	if err != nil {
-		return err
-	}
-	err = t.Execute(&body, struct {
-		VisitID string
-		Date    string
-		Name    string
-	}{
-		VisitID: visitID,
-		Date:    date,
-		Name:    name,
-	})
+	// the token is only stored as hash, so a new one has to be created for the mail. this revokes the old link
+	token, err := newInvitationToken(&visit)
 	if err != nil {
-		return err
-	}
-	host, _, _ := net.SplitHostPort(smtpHost)
-
-	tlsconfig := &tls.Config{
-		ServerName: host,
-	}
-
-	conn, err := net.Dial("tcp", smtpHost)
-	if err != nil {
-		return err
-	}
-
-	c, err := smtp.NewClient(conn, host)
-	if err != nil {
-		return err
-	}
-
-	if err := c.StartTLS(tlsconfig); err != nil {
-		return err
-	}
-
-	if err = c.Auth(LoginAuth(from.Address, password)); err != nil {
-		return err
+		logrus.Error(err)
+		c.JSON(http.StatusInternalServerError, ErrorInternalError)
+		return
 	}
-
-	if err = c.Mail(from.Address); err != nil {
-		return err
+	update := bson.M{"$set": bson.M{"invitationtoken": visit.InvitationToken, "invitationexpiresat": visit.InvitationExpiresAt}}
+	if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, f, update); err != nil {
+		logrus.Error(err)
+		c.JSON(http.StatusInternalServerError, ErrorInternalError)
+		return
 	}
 
-	if err = c.Rcpt(to.Address); err != nil {
-		return err
+	if err := sendInvitationMail(visit, token); err != nil {
+		logrus.Error(err)
+		c.JSON(http.StatusInternalServerError, ErrorInternalError)
+		return
 	}
+	c.Status(http.StatusOK)
+}
 
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		return err
-	}
+// sendInvitationMail queues the invitation mail for the guest of the visit including a calendar attachment
+// and the qr code for the check-in at the reception.
+// token is the invitation token used in the link of the mail
+func sendInvitationMail(v Visit, token string) error {
+	return sendVisitMail(v, token, "", "invitation")
+}
 
-	_, err = w.Write(body.Bytes())
-	if err != nil {
-		return err
-	}
+// sendVisitUpdateMail tells the guest about the new date of the visit. the guest has to accept the
+// invitation again, so the mail contains the same link, calendar entry and qr code as the invitation
+func sendVisitUpdateMail(v Visit, token string) error {
+	return sendVisitMail(v, token, "", "visit-update")
+}
 
-	err = w.Close()
+// sendVisitMail queues a mail with the invitation link, calendar entry and qr code of the visit. optOutToken
+// is only used by mails offering to unsubscribe from reminders
+func sendVisitMail(v Visit, token, optOutToken, tmpl string) error {
+	l := v.Visitor.Locale
+	name := v.Visitor.FirstName + " " + v.Visitor.LastName
+	qr, err := checkInQRCode(token)
 	if err != nil {
 		return err
 	}
+	return queueMail(l, v.Visitor.Email, name, tmpl, struct {
+		Token       string
+		OptOutToken string
+		Date        string
+		Name        string
+		Supervisor  string
+		Parking     *ParkingAssignment
+	}{
+		Token:       token,
+		OptOutToken: optOutToken,
+		Date:        formatDateRange(l, v),
+		Name:        name,
+		Supervisor:  v.Supervisor.DisplayName,
+		Parking:     v.Parking,
+	}, MailAttachment{
+		FileName:    "invitation.ics",
+		ContentType: "text/calendar; charset=\"UTF-8\"; method=PUBLISH",
+		Data:        visitICS(v),
+	}, MailAttachment{
+		FileName:    "check-in.png",
+		ContentType: "image/png",
+		Data:        qr,
+		ContentID:   checkInQRCodeID,
+	})
+}
 
-	return c.Quit()
+// sendCancellationMail tells the guest that the visit has been cancelled by the host
+func sendCancellationMail(v Visit) error {
+	l := v.Visitor.Locale
+	name := v.Visitor.FirstName + " " + v.Visitor.LastName
+	return queueMail(l, v.Visitor.Email, name, "visit-cancellation", struct {
+		Date       string
+		Name       string
+		Supervisor string
+	}{
+		Date:       formatDateRange(l, v),
+		Name:       name,
+		Supervisor: v.Supervisor.DisplayName,
+	})
 }
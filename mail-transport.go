@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// mailTransport delivers a raw mime message to a single recipient
+type mailTransport interface {
+	Send(from, to string, msg []byte) error
+}
+
+// mailer is the transport used by the mail worker. it is selected by the email transport setting
+var mailer mailTransport
+
+func initMailTransport() {
+	var err error
+	mailer, err = newMailTransport()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.WithField("transport", fmt.Sprintf("%T", mailer)).Info("initialized mail transport")
+}
+
+func newMailTransport() (mailTransport, error) {
+	switch cfg.Email.Transport {
+	case "", "smtp":
+		username := cfg.Email.Username
+		if username == "" {
+			username = cfg.Email.FromMail
+		}
+		security := cfg.Email.Security
+		if security == "" {
+			security = "starttls"
+		}
+		auth := cfg.Email.Auth
+		if auth == "" {
+			auth = "login"
+		}
+		if security != "starttls" && security != "tls" && security != "none" {
+			return nil, fmt.Errorf("unknown smtp security %s. must be starttls, tls or none", security)
+		}
+		if auth != "login" && auth != "plain" && auth != "none" {
+			return nil, fmt.Errorf("unknown smtp auth %s. must be login, plain or none", auth)
+		}
+		return &smtpTransport{
+			Host:     cfg.Email.Host,
+			Port:     cfg.Email.Port,
+			Username: username,
+			Password: cfg.Email.Password,
+			Security: security,
+			Auth:     auth,
+		}, nil
+	case "file":
+		dir := cfg.Email.Directory
+		if dir == "" {
+			dir = "mail-out"
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &fileTransport{Directory: dir}, nil
+	case "log":
+		return &logTransport{}, nil
+	case "memory":
+		return &memoryTransport{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %s. must be smtp, file, log or memory", cfg.Email.Transport)
+}
+
+// smtpTransport sends mails via an smtp server
+type smtpTransport struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// Security is starttls, tls for implicit tls or none
+	Security string
+	// Auth is login, plain or none
+	Auth string
+}
+
+const (
+	smtpDialTimeout = time.Second * 30
+	// smtpSendTimeout limits the whole smtp exchange of a mail, so a hanging server does not block the mail
+	// worker. it has to be shorter than mailSendingTimeout, otherwise the mail would be claimed again
+	smtpSendTimeout = time.Minute * 2
+)
+
+func (t *smtpTransport) Send(from, to string, msg []byte) error {
+	addr := net.JoinHostPort(t.Host, t.Port)
+	tlsConfig := &tls.Config{ServerName: t.Host}
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if t.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpSendTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if t.Security == "starttls" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	switch t.Auth {
+	case "login":
+		err = c.Auth(LoginAuth(t.Username, t.Password))
+	case "plain":
+		err = c.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+type loginAuth struct {
+	username, password string
+}
+
+func LoginAuth(username, password string) smtp.Auth {
+	return &loginAuth{username, password}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", []byte(a.username), nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		switch string(fromServer) {
+		case "Username:":
+			return []byte(a.username), nil
+		case "Password:":
+			return []byte(a.password), nil
+		default:
+			return nil, errors.New("Unknown from server")
+		}
+	}
+	return nil, nil
+}
+
+// fileTransport writes every mail as .eml file into a directory, so the invitation flow can be
+// tested locally without a mail server
+type fileTransport struct {
+	Directory string
+}
+
+func (t *fileTransport) Send(from, to string, msg []byte) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), to)
+	p := filepath.Join(t.Directory, filepath.Base(name))
+	if err := ioutil.WriteFile(p, msg, 0644); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"to": to, "file": p}).Info("wrote mail to file")
+	return nil
+}
+
+// logTransport only logs the mails instead of sending them
+type logTransport struct{}
+
+func (t *logTransport) Send(from, to string, msg []byte) error {
+	logrus.WithFields(logrus.Fields{"from": from, "to": to}).Info("mail:\n" + string(msg))
+	return nil
+}
+
+// CapturedMail is a mail received by the memory transport
+type CapturedMail struct {
+	From    string
+	To      string
+	Message []byte
+}
+
+// memoryTransport keeps all mails in memory, e.g. for tests
+type memoryTransport struct {
+	mu    sync.Mutex
+	Mails []CapturedMail
+}
+
+func (t *memoryTransport) Send(from, to string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Mails = append(t.Mails, CapturedMail{From: from, To: to, Message: msg})
+	return nil
+}
+
+// Captured returns a copy of all mails sent so far
+func (t *memoryTransport) Captured() []CapturedMail {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]CapturedMail(nil), t.Mails...)
+}
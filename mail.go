@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	mailStatusPending = "pending"
+	mailStatusSending = "sending"
+	mailStatusSent    = "sent"
+	mailStatusFailed  = "failed"
+
+	mailMaxAttempts  = 8
+	mailRetryDelay   = time.Minute
+	mailPollInterval = time.Second * 15
+	// mails which are in sending state for longer than this are considered lost, e.g. because the
+	// service has been restarted while sending them
+	mailSendingTimeout = time.Minute * 10
+)
+
+// mailTemplate describes a single kind of mail. html and text are file names inside mail-templates,
+// the subject is looked up in the translation catalogs by the key mail.<template>.subject
+type mailTemplate struct {
+	HTML string
+	Text string
+}
+
+// mailTemplates is the registry of all mails the service is able to send
+var mailTemplates = map[string]mailTemplate{
+	"invitation": {
+		HTML: "invitation.html",
+		Text: "invitation.txt",
+	},
+	"visit-cancellation": {
+		HTML: "visit-cancellation.html",
+		Text: "visit-cancellation.txt",
+	},
+	"invitation-response": {
+		HTML: "invitation-response.html",
+		Text: "invitation-response.txt",
+	},
+	"visit-update": {
+		HTML: "visit-update.html",
+		Text: "visit-update.txt",
+	},
+	"visitor-arrived": {
+		HTML: "visitor-arrived.html",
+		Text: "visitor-arrived.txt",
+	},
+	"host-visit-reminder": {
+		HTML: "host-visit-reminder.html",
+		Text: "host-visit-reminder.txt",
+	},
+	"invitation-reminder": {
+		HTML: "invitation-reminder.html",
+		Text: "invitation-reminder.txt",
+	},
+	"booking-reminder": {
+		HTML: "booking-reminder.html",
+		Text: "booking-reminder.txt",
+	},
+}
+
+// MailAttachment is a file sent along with a mail
+type MailAttachment struct {
+	FileName    string `bson:"file_name" json:"file_name"`
+	ContentType string `bson:"content_type" json:"content_type"`
+	Data        []byte `bson:"data" json:"-"`
+	// ContentID marks the attachment as inline, so the html part can reference it as cid:<ContentID>
+	ContentID string `bson:"content_id,omitempty" json:"content_id,omitempty"`
+}
+
+// OutgoingMail is a rendered mail waiting in the outbox collection until it is delivered. only the metadata
+// is kept after the delivery
+type OutgoingMail struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Template    string             `bson:"template" json:"template"`
+	Locale      string             `bson:"locale" json:"locale"`
+	To          string             `bson:"to" json:"to"`
+	ToName      string             `bson:"to_name" json:"to_name"`
+	Subject     string             `bson:"subject" json:"subject"`
+	HTML        string             `bson:"html" json:"-"`
+	Text        string             `bson:"text" json:"-"`
+	Attachments []MailAttachment   `bson:"attachments" json:"attachments"`
+	Status      string             `bson:"status" json:"status"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	LastError   string             `bson:"last_error" json:"last_error,omitempty"`
+	NextAttempt time.Time          `bson:"next_attempt" json:"next_attempt"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	SentAt      time.Time          `bson:"sent_at" json:"sent_at,omitempty"`
+}
+
+// mailQueued wakes up the mail worker, so new mails do not have to wait for the next poll
+var mailQueued = make(chan struct{}, 1)
+
+// queueMail renders the template in the language of the recipient and stores the mail in the outbox.
+// the mail worker delivers it afterwards
+func queueMail(locale, to, name, tmpl string, data interface{}, attachments ...MailAttachment) error {
+	mt, ok := mailTemplates[tmpl]
+	if !ok {
+		return fmt.Errorf("unknown mail template %s", tmpl)
+	}
+	m := OutgoingMail{
+		ID:          primitive.NewObjectID(),
+		Template:    tmpl,
+		Locale:      locale,
+		To:          to,
+		ToName:      name,
+		Attachments: attachments,
+		Status:      mailStatusPending,
+		NextAttempt: time.Now(),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	var b bytes.Buffer
+	st, err := texttemplate.New("subject").Parse(translate(locale, "mail."+tmpl+".subject"))
+	if err != nil {
+		return err
+	}
+	if err := st.Execute(&b, data); err != nil {
+		return err
+	}
+	m.Subject = b.String()
+
+	b.Reset()
+	ht, err := htmltemplate.ParseFiles(localizedTemplate(locale, mt.HTML))
+	if err != nil {
+		return err
+	}
+	if err := ht.Execute(&b, data); err != nil {
+		return err
+	}
+	m.HTML = b.String()
+
+	b.Reset()
+	tt, err := texttemplate.ParseFiles(localizedTemplate(locale, mt.Text))
+	if err != nil {
+		return err
+	}
+	if err := tt.Execute(&b, data); err != nil {
+		return err
+	}
+	m.Text = b.String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := client.Database("office_checkin").Collection("mail_outbox").InsertOne(ctx, m); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"template": tmpl, "mail_id": m.ID.Hex()}).Debug("queued mail")
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// runMailWorker delivers the mails of the outbox until there are no more mails due
+func runMailWorker() {
+	t := time.NewTicker(mailPollInterval)
+	defer t.Stop()
+	for {
+		for processNextMail() {
+		}
+		select {
+		case <-t.C:
+		case <-mailQueued:
+		}
+	}
+}
+
+// processNextMail claims a single due mail and tries to deliver it. it returns false if there was no mail due
+func processNextMail() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	now := time.Now()
+	f := bson.M{"$or": bson.A{
+		bson.M{"status": mailStatusPending, "next_attempt": bson.M{"$lte": now}},
+		bson.M{"status": mailStatusSending, "updated_at": bson.M{"$lte": now.Add(-mailSendingTimeout)}},
+	}}
+	update := bson.M{"$set": bson.M{"status": mailStatusSending, "updated_at": now}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{"next_attempt", 1}}).SetReturnDocument(options.After)
+	var m OutgoingMail
+	err := client.Database("office_checkin").Collection("mail_outbox").FindOneAndUpdate(ctx, f, update, opts).Decode(&m)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logrus.Error(err)
+		}
+		return false
+	}
+
+	log := logrus.WithFields(logrus.Fields{"mail_id": m.ID.Hex(), "template": m.Template, "attempt": m.Attempts + 1})
+	err = deliverMail(m)
+	m.Attempts++
+	m.UpdatedAt = time.Now()
+	if err == nil {
+		log.Info("delivered mail")
+		m.Status = mailStatusSent
+		m.SentAt = m.UpdatedAt
+		m.LastError = ""
+	} else {
+		log.Warn(err)
+		m.LastError = err.Error()
+		m.Status = mailStatusPending
+		m.NextAttempt = m.UpdatedAt.Add(mailRetryDelay * time.Duration(1<<uint(m.Attempts-1)))
+		if m.Attempts >= mailMaxAttempts {
+			log.Error("giving up delivering mail")
+			m.Status = mailStatusFailed
+		}
+	}
+	result := bson.M{"$set": bson.M{
+		"status": m.Status, "attempts": m.Attempts, "last_error": m.LastError,
+		"next_attempt": m.NextAttempt, "updated_at": m.UpdatedAt, "sent_at": m.SentAt,
+	}}
+	// the bodies and attachments contain the links and qr codes with the plaintext tokens of the recipient,
+	// they must not be kept once they are not needed for another attempt anymore. the tokens are only stored
+	// as hash, so a failed mail cannot be rendered again and has to be triggered again, e.g. by resending
+	// the invitation
+	if m.Status == mailStatusSent || m.Status == mailStatusFailed {
+		result["$unset"] = mailContent
+	}
+	// delivering the mail might have taken longer than the context of the claim allows
+	uctx, ucancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer ucancel()
+	if _, err := client.Database("office_checkin").Collection("mail_outbox").UpdateOne(uctx, bson.D{{"_id", m.ID}}, result); err != nil {
+		logrus.Error(err)
+	}
+	return true
+}
+
+// mailContent are the fields of an outgoing mail which are only needed until it has been delivered
+var mailContent = bson.M{"html": "", "text": "", "attachments": ""}
+
+// purgeSentMailContent removes the content of mails which have been delivered or have failed before the
+// content was removed after the last attempt
+func purgeSentMailContent() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	f := bson.D{{"status", bson.D{{"$in", bson.A{mailStatusSent, mailStatusFailed}}}}, {"$or", bson.A{
+		bson.D{{"html", bson.D{{"$exists", true}}}},
+		bson.D{{"attachments", bson.D{{"$exists", true}}}},
+	}}}
+	r, err := client.Database("office_checkin").Collection("mail_outbox").UpdateMany(ctx, f, bson.M{"$unset": mailContent})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if r.ModifiedCount > 0 {
+		logrus.WithField("mails", r.ModifiedCount).Info("removed the content of delivered and failed mails")
+	}
+}
+
+// deliverMail builds the mime message and hands it over to the configured transport
+func deliverMail(m OutgoingMail) error {
+	msg, err := buildMessage(m)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(cfg.Email.FromMail, m.To, msg)
+}
+
+// buildMessage creates the raw mime message with a text and a html alternative and all attachments
+func buildMessage(m OutgoingMail) ([]byte, error) {
+	from := mail.Address{Name: cfg.Email.FromName, Address: cfg.Email.FromMail}
+	to := mail.Address{Name: m.ToName, Address: m.To}
+	domain := "localhost"
+	if i := strings.LastIndex(cfg.Email.FromMail, "@"); i >= 0 {
+		domain = cfg.Email.FromMail[i+1:]
+	}
+
+	// the alternative part is rendered first, because its boundary is needed for the surrounding part
+	var altBody bytes.Buffer
+	alt := multipart.NewWriter(&altBody)
+	tp, err := alt.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=\"UTF-8\""},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(tp, m.Text); err != nil {
+		return nil, err
+	}
+	hp, err := alt.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=\"UTF-8\""},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(hp, m.HTML); err != nil {
+		return nil, err
+	}
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	mixed := multipart.NewWriter(&msg)
+	msg.WriteString("From: " + from.String() + "\r\n")
+	msg.WriteString("To: " + to.String() + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString(fmt.Sprintf("Message-ID: <%s@%s>\r\n", m.ID.Hex(), domain))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/mixed; boundary=\"" + mixed.Boundary() + "\"\r\n\r\n")
+
+	ap, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=\"" + alt.Boundary() + "\""}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ap.Write(altBody.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, a := range m.Attachments {
+		h := textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType + "; name=\"" + a.FileName + "\""},
+			"Content-Disposition":       {"attachment; filename=\"" + a.FileName + "\""},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if a.ContentID != "" {
+			h.Set("Content-Disposition", "inline; filename=\""+a.FileName+"\"")
+			h.Set("Content-ID", "<"+a.ContentID+">")
+		}
+		p, err := mixed.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(p, a.Data)
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		w.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	w.Write([]byte(enc + "\r\n"))
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// getMails lists the mails of the outbox for admins, by default only the failed ones
+func getMails(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	f := bson.D{{"status", c.DefaultQuery("status", mailStatusFailed)}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}}).SetLimit(200).SetProjection(bson.D{{"html", 0}, {"text", 0}, {"attachments.data", 0}})
+	cur, err := client.Database("office_checkin").Collection("mail_outbox").Find(ctx, f, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	mails := []OutgoingMail{}
+	if err := cur.All(ctx, &mails); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, mails)
+}
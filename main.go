@@ -31,6 +31,17 @@ func main() {
 	initFirebase()
 	client = connectToDB()
 	initSettings()
+	initMailTransport()
+	initTaskLeases()
+	// visits need their site before they are counted against the capacity of the site
+	migrateVisitSites()
+	initVisitorCapacity()
+	go migrateVisitorDirectory()
+	go migrateInvitationTokens()
+	go migrateCalendarTokens()
+	go purgeSentMailContent()
+	go migrateReminderOptOut()
+	go ensureParkingIndexes()
 
 	gin.SetMode(gin.ReleaseMode)
 	e := gin.New()
@@ -55,6 +66,31 @@ func main() {
 	areas.GET(":id/forecast", getForecast)
 	areas.OPTIONS(":id/forecast")
 
+	sites := api.Group("sites")
+	sites.Use(cors.Default(), authMiddleware())
+	sites.GET(":location/visitor-availability", getVisitorAvailability)
+	sites.OPTIONS(":location/visitor-availability")
+
+	// the occupancy streams are read with EventSource, which can only pass the token in the url
+	streams := api.Group("")
+	streams.Use(cors.Default(), streamToken(), authMiddleware())
+	streams.GET("areas/:id/occupancy-stream", streamAreaOccupancy)
+	streams.OPTIONS("areas/:id/occupancy-stream")
+	streams.GET("sites/:location/occupancy-stream", streamSiteOccupancy)
+	streams.OPTIONS("sites/:location/occupancy-stream")
+
+	parking := api.Group("parking")
+	parking.Use(cors.Default(), authMiddleware())
+	parking.GET("lots", getParkingLots)
+	parking.GET("lots/:id/availability", getParkingAvailability)
+	parking.GET("bookings", getParkingBookings)
+	parking.POST("bookings", addParkingBooking)
+	parking.DELETE("bookings/:id", deleteParkingBooking)
+	parking.OPTIONS("lots")
+	parking.OPTIONS("lots/:id/availability")
+	parking.OPTIONS("bookings")
+	parking.OPTIONS("bookings/:id")
+
 	bookings := api.Group("bookings")
 	bookings.Use(cors.Default(), authMiddleware())
 	bookings.OPTIONS("")
@@ -73,18 +109,59 @@ func main() {
 	admin.GET("refresh-settings", refreshSettingsHandler)
 	admin.GET("users/:mail/covid-backtracing", covidBacktracing)
 	admin.GET("visitor-badges/:date", handlePrintRequest)
+	admin.GET("exports/bookings", exportBookings)
+	admin.GET("exports/visits", exportVisits)
+	admin.GET("webhooks", getWebhooks)
+	admin.POST("webhooks", addWebhook)
+	admin.DELETE("webhooks/:id", deleteWebhook)
+	admin.GET("webhooks/:id/deliveries", getWebhookDeliveries)
+	admin.POST("webhook-deliveries/:id/redeliver", redeliverWebhook)
+	admin.POST("parking-lots", addParkingLot)
+	admin.DELETE("parking-lots/:id", deleteParkingLot)
+	admin.GET("parking-bookings/:date", adminGetParkingBookingsForDate)
+	admin.GET("legal-documents", getLegalDocuments)
+	admin.POST("legal-documents", addLegalDocument)
+	admin.GET("visits/:id/acceptance-record", getAcceptanceRecord)
+	admin.GET("retention-runs", getRetentionRuns)
+	admin.GET("tasks", getTasks)
+	admin.POST("tasks/:name/run", runTask)
+	admin.GET("statistics/bookings", getBookingStatistics)
+	admin.GET("mails", getMails)
 
 	admin.OPTIONS("bookings")
 	admin.OPTIONS("bookings/:date")
 	admin.OPTIONS("refresh-settings")
 	admin.OPTIONS("users/:mail/covid-backtracing")
 	admin.OPTIONS("visitor-badges/:date")
+	admin.OPTIONS("exports/bookings")
+	admin.OPTIONS("exports/visits")
+	admin.OPTIONS("webhooks")
+	admin.OPTIONS("webhooks/:id")
+	admin.OPTIONS("webhooks/:id/deliveries")
+	admin.OPTIONS("webhook-deliveries/:id/redeliver")
+	admin.OPTIONS("parking-lots")
+	admin.OPTIONS("parking-lots/:id")
+	admin.OPTIONS("parking-bookings/:date")
+	admin.OPTIONS("legal-documents")
+	admin.OPTIONS("visits/:id/acceptance-record")
+	admin.OPTIONS("retention-runs")
+	admin.OPTIONS("tasks")
+	admin.OPTIONS("tasks/:name/run")
+	admin.OPTIONS("statistics/bookings")
+	admin.OPTIONS("mails")
 
 	user := api.Group("user")
 	user.Use(cors.Default(), authMiddleware())
 	user.OPTIONS("")
 	user.GET("", getUser)
 	user.PUT("", updateUser)
+	user.GET("calendar-token", getCalendarToken)
+	user.POST("calendar-token", rotateCalendarToken)
+	user.OPTIONS("calendar-token")
+
+	calendar := api.Group("calendar")
+	calendar.Use(cors.Default(), rateLimit(calendarLookups))
+	calendar.GET(":token", getCalendarFeed)
 
 
 	users := api.Group("users")
@@ -99,6 +176,7 @@ func main() {
 	visitors.POST("", addVisitor)
 	visitors.GET("", getVisitors)
 	visitors.GET(":id", getVisitor)
+	visitors.PUT(":id", updateVisitor)
 	visitors.DELETE(":id", deleteVisitor)
 	visitors.OPTIONS("")
 	visitors.OPTIONS(":id")
@@ -108,19 +186,48 @@ func main() {
 	visits.POST("", addVisit)
 	visits.GET("", getVisits)
 	visits.GET(":id")
+	visits.PATCH(":id", updateVisit)
 	visits.DELETE(":id", deleteVisit)
 	visits.OPTIONS("")
 	visits.OPTIONS(":id")
 
 	invitations := api.Group("invitations")
-	invitations.Use(cors.Default())
+	invitations.Use(cors.Default(), rateLimit(invitationLookups))
 	invitations.GET(":id", getSingleVisit)
 	invitations.PATCH(":id", acceptInvitation)
 	invitations.OPTIONS(":id")
 	invitations.POST(":id/resend-mail", authMiddleware(), resendMail)
 	invitations.OPTIONS(":id/resend-mail")
+	invitations.GET(":id/documents", getInvitationDocuments)
+	invitations.OPTIONS(":id/documents")
+	invitations.PUT(":id/registration", submitRegistration)
+	invitations.OPTIONS(":id/registration")
+	invitations.POST(":id/reminder-opt-out", optOutOfGuestReminders)
+	invitations.OPTIONS(":id/reminder-opt-out")
+
+	reminderOptOuts := api.Group("reminder-opt-outs")
+	reminderOptOuts.Use(cors.Default(), rateLimit(invitationLookups))
+	reminderOptOuts.POST(":token", optOutOfGuestRemindersByToken)
+	reminderOptOuts.OPTIONS(":token")
+
+	bookingCancellations := api.Group("booking-cancellations")
+	bookingCancellations.Use(cors.Default(), rateLimit(bookingCancellationLookups))
+	bookingCancellations.GET(":token", getBookingCancellation)
+	bookingCancellations.POST(":token", cancelBookingByToken)
+	bookingCancellations.OPTIONS(":token")
+
+	reception := api.Group("reception")
+	reception.Use(cors.Default(), authMiddleware())
+	reception.POST("check-in", checkInVisitor)
+	reception.POST("check-out", checkOutVisitor)
+	reception.GET("present", getPresentVisitors)
+	reception.OPTIONS("check-in")
+	reception.OPTIONS("check-out")
+	reception.OPTIONS("present")
 
 	go runTasks()
+	go runWebhookDispatcher()
+	go runMailWorker()
 
 	logrus.Fatal(http.ListenAndServe(":3000", e))
 
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	channelMail = "mail"
+	// channelChat announces the notification in the team chat configured by chat_webhook_url
+	channelChat = "chat"
+)
+
+const (
+	notificationBookingReminder    = "booking_reminder"
+	notificationHostVisitReminder  = "host_visit_reminder"
+	notificationInvitationResponse = "invitation_response"
+	notificationVisitorArrived     = "visitor_arrived"
+)
+
+var notificationChannels = []string{channelMail, channelChat}
+
+var notificationTypes = []string{
+	notificationBookingReminder,
+	notificationHostVisitReminder,
+	notificationInvitationResponse,
+	notificationVisitorArrived,
+}
+
+// NotificationPreferences defines which notifications a user receives and on which channels. reminders are
+// only sent by mail
+type NotificationPreferences struct {
+	Channels []string `bson:"channels" json:"channels"`
+	Events   []string `bson:"events" json:"events"`
+	// ReminderHour is the hour of the day before a booking or visit after which reminders are sent.
+	// without it the hour configured for the service is used
+	ReminderHour *int `bson:"reminder_hour" json:"reminder_hour"`
+}
+
+// defaultNotificationPreferences are used for users who never changed their preferences. the team chat is
+// shared with everyone, so users have to opt in before their notifications and the names of their guests
+// are posted there
+func defaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{
+		Channels: []string{channelMail},
+		Events:   append([]string{}, notificationTypes...),
+	}
+}
+
+// notificationPreferences returns the preferences of the user or the defaults if there are none
+func (u User) notificationPreferences() NotificationPreferences {
+	if u.Notifications == nil {
+		return defaultNotificationPreferences()
+	}
+	return *u.Notifications
+}
+
+// wants reports whether the notification should be sent on the channel
+func (p NotificationPreferences) wants(event, channel string) bool {
+	return containsString(p.Events, event) && containsString(p.Channels, channel)
+}
+
+// reminderHour returns the hour after which reminders are sent to the user
+func (p NotificationPreferences) reminderHour(def int) int {
+	if p.ReminderHour == nil {
+		return def
+	}
+	return *p.ReminderHour
+}
+
+// validateNotificationPreferences removes duplicates from the preferences and returns all validation errors
+func validateNotificationPreferences(p *NotificationPreferences) []string {
+	errs := []string{}
+	if p.Channels == nil {
+		p.Channels = []string{}
+	}
+	if p.Events == nil {
+		p.Events = []string{}
+	}
+	p.Channels = uniqueStrings(lowerStrings(p.Channels))
+	p.Events = uniqueStrings(lowerStrings(p.Events))
+	for _, c := range p.Channels {
+		if !containsString(notificationChannels, c) {
+			errs = append(errs, "channel must be one of "+strings.Join(notificationChannels, ", "))
+			break
+		}
+	}
+	for _, e := range p.Events {
+		if !containsString(notificationTypes, e) {
+			errs = append(errs, "event must be one of "+strings.Join(notificationTypes, ", "))
+			break
+		}
+	}
+	if p.ReminderHour != nil && (*p.ReminderHour < 0 || *p.ReminderHour > 23) {
+		errs = append(errs, "reminder hour must be between 0 and 23")
+	}
+	return errs
+}
+
+// findUserByMail returns the profile of the user with the mail address. hosts of visits are only known by
+// their mail address
+func findUserByMail(ctx context.Context, email string) (u User, err error) {
+	if email == "" {
+		return u, mongo.ErrNoDocuments
+	}
+	f := bson.D{{"email", primitive.Regex{Pattern: "^" + regexp.QuoteMeta(email) + "$", Options: "i"}}}
+	err = client.Database("office_checkin").Collection("users").FindOne(ctx, f).Decode(&u)
+	return
+}
+
+// hostUser returns the profile of the supervisor of the visit. ok is false if the supervisor has no profile,
+// the defaults apply to such hosts
+func hostUser(v Visit) (User, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	u, err := findUserByMail(ctx, v.Supervisor.Email)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logrus.Error(err)
+		}
+		return User{}, false
+	}
+	return u, true
+}
+
+// migrateReminderOptOut turns the reminder opt-out of users, which existed before the notification preferences,
+// into preferences without booking reminders and removes the old field
+func migrateReminderOptOut() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	coll := client.Database("office_checkin").Collection("users")
+	p := defaultNotificationPreferences()
+	p.Events = removeString(p.Events, notificationBookingReminder)
+	f := bson.D{{"reminderoptout", true}, {"notifications", bson.D{{"$type", "object"}}}}
+	changed, err := coll.UpdateMany(ctx, f, bson.M{"$pull": bson.M{"notifications.events": notificationBookingReminder}})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	f = bson.D{{"reminderoptout", true}, {"notifications", bson.D{{"$not", bson.D{{"$type", "object"}}}}}}
+	created, err := coll.UpdateMany(ctx, f, bson.M{"$set": bson.M{"notifications": p}})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	// the field is only removed once the opt-out has been kept in the preferences of every user
+	if _, err := coll.UpdateMany(ctx, bson.D{{"reminderoptout", bson.D{{"$exists", true}}}}, bson.M{"$unset": bson.M{"reminderoptout": ""}}); err != nil {
+		logrus.Error(err)
+		return
+	}
+	if n := changed.ModifiedCount + created.ModifiedCount; n > 0 {
+		logrus.WithField("users", n).Info("moved the reminder opt-out of users to their notification preferences")
+	}
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(s []string, v string) []string {
+	res := make([]string, 0, len(s))
+	for _, e := range s {
+		if e != v {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func lowerStrings(s []string) []string {
+	res := make([]string, 0, len(s))
+	for _, v := range s {
+		res = append(res, strings.ToLower(strings.TrimSpace(v)))
+	}
+	return res
+}
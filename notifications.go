@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+// hostLocale returns the locale of the user hosting the visit
+func hostLocale(v Visit) string {
+	if u, ok := hostUser(v); ok && u.Locale != "" {
+		return u.Locale
+	}
+	if u, err := getSingleUser(v.User); err == nil && u.Locale != "" {
+		return u.Locale
+	}
+	return defaultLocale
+}
+
+// notifyHostAboutResponse tells the supervisor how the guest answered the invitation
+func notifyHostAboutResponse(v Visit, r InvitationResponse) error {
+	if v.Supervisor.Email == "" {
+		return nil
+	}
+	u, _ := hostUser(v)
+	p := u.notificationPreferences()
+	l := hostLocale(v)
+	guest := v.Visitor.FirstName + " " + v.Visitor.LastName
+	answer := translate(l, "invitation.status."+r.Status)
+	proposed := ""
+	if r.ProposedDate != "" {
+		proposed = formatDate(l, r.ProposedDate)
+	}
+	if p.wants(notificationInvitationResponse, channelChat) {
+		postChatMessage(fmt.Sprintf("%s %s (%s, %s)", guest, translate(defaultLocale, "invitation.status."+r.Status), v.Supervisor.DisplayName, v.Date))
+	}
+	if !p.wants(notificationInvitationResponse, channelMail) {
+		return nil
+	}
+	return queueMail(l, v.Supervisor.Email, v.Supervisor.DisplayName, "invitation-response", struct {
+		Name         string
+		Guest        string
+		Date         string
+		Status       string
+		Answer       string
+		Message      string
+		ProposedDate string
+	}{
+		Name:         v.Supervisor.DisplayName,
+		Guest:        guest,
+		Date:         formatDateRange(l, v),
+		Status:       r.Status,
+		Answer:       answer,
+		Message:      r.Message,
+		ProposedDate: proposed,
+	})
+}
+
+// notifyHostAboutArrival tells the supervisor that the guest has been checked in at the reception
+func notifyHostAboutArrival(v Visit, at time.Time) error {
+	if v.Supervisor.Email == "" {
+		return nil
+	}
+	u, _ := hostUser(v)
+	p := u.notificationPreferences()
+	l := hostLocale(v)
+	guest := v.Visitor.FirstName + " " + v.Visitor.LastName
+	if p.wants(notificationVisitorArrived, channelChat) {
+		postChatMessage(fmt.Sprintf(translate(defaultLocale, "chat.visitor_arrived"), guest, v.Supervisor.DisplayName))
+	}
+	if !p.wants(notificationVisitorArrived, channelMail) {
+		return nil
+	}
+	return queueMail(l, v.Supervisor.Email, v.Supervisor.DisplayName, "visitor-arrived", struct {
+		Name    string
+		Guest   string
+		Company string
+		Time    string
+	}{
+		Name:    v.Supervisor.DisplayName,
+		Guest:   guest,
+		Company: v.Visitor.Company,
+		Time:    at.Format("15:04"),
+	})
+}
+
+// postChatMessage sends a short message to the configured chat webhook. slack and teams both understand
+// the simple text payload of their incoming webhooks
+func postChatMessage(text string) {
+	u := cfg.Notifications.ChatWebhookURL
+	if u == "" {
+		return
+	}
+	go func() {
+		b, err := json.Marshal(struct {
+			Text string `json:"text"`
+		}{Text: text})
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		res, err := webhookClient.Post(u, "application/json", bytes.NewReader(b))
+		if err != nil {
+			logrus.Warn(err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			logrus.WithField("status", res.StatusCode).Warn("chat webhook did not accept the message")
+		}
+	}()
+}
+
+// hostReminderGuest is a single line of the reminder mail sent to the hosts
+type hostReminderGuest struct {
+	Name     string
+	Company  string
+	Accepted bool
+}
+
+// sendHostVisitReminders sends every host a list of the guests arriving tomorrow. guests of visits spanning
+// several days are only listed before the first day. the reminders are sent once a day after the reminder hour
+// of the host, hosts who do not want to be reminded are skipped
+func sendHostVisitReminders() error {
+	now := time.Now()
+	tomorrow := now.Add(time.Hour * 24).Format("2006-01-02")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	f := bson.D{
+		{"date", tomorrow},
+		{"hostremindersent", bson.D{{"$ne", true}}},
+		{"invitationstatus", bson.D{{"$ne", InvitationStatusDeclined}}},
+	}
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
+	if err != nil {
+		return err
+	}
+	var visits []Visit
+	if err := cur.All(ctx, &visits); err != nil {
+		return err
+	}
+	if len(visits) == 0 {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{"date": tomorrow, "visits": len(visits)}).Info("sending visit reminders to hosts")
+
+	failed := 0
+	hosts := make(map[string][]Visit)
+	for _, v := range visits {
+		hosts[v.Supervisor.Email] = append(hosts[v.Supervisor.Email], v)
+	}
+	for mail, vs := range hosts {
+		if mail == "" {
+			continue
+		}
+		u, _ := hostUser(vs[0])
+		p := u.notificationPreferences()
+		if now.Hour() < p.reminderHour(cfg.Notifications.HostReminderHour) {
+			continue
+		}
+		ids := bson.A{}
+		for _, v := range vs {
+			ids = append(ids, v.ID)
+		}
+		if !p.wants(notificationHostVisitReminder, channelMail) {
+			markHostReminderSent(ctx, ids)
+			continue
+		}
+		l := hostLocale(vs[0])
+		guests := []hostReminderGuest{}
+		for _, v := range vs {
+			guests = append(guests, hostReminderGuest{
+				Name:     v.Visitor.FirstName + " " + v.Visitor.LastName,
+				Company:  v.Visitor.Company,
+				Accepted: v.HasAccepted,
+			})
+		}
+		err := queueMail(l, mail, vs[0].Supervisor.DisplayName, "host-visit-reminder", struct {
+			Name   string
+			Date   string
+			Guests []hostReminderGuest
+		}{
+			Name:   vs[0].Supervisor.DisplayName,
+			Date:   formatDate(l, tomorrow),
+			Guests: guests,
+		})
+		if err != nil {
+			logrus.Error(err)
+			failed++
+			continue
+		}
+		markHostReminderSent(ctx, ids)
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not queue the reminders of %d hosts", failed)
+	}
+	return nil
+}
+
+func markHostReminderSent(ctx context.Context, ids bson.A) {
+	f := bson.D{{"_id", bson.D{{"$in", ids}}}}
+	update := bson.M{"$set": bson.M{"hostremindersent": true}}
+	if _, err := client.Database("office_checkin").Collection("visits").UpdateMany(ctx, f, update); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// occupancyHeartbeat is the interval of keep alive messages, so proxies do not close idle streams
+const occupancyHeartbeat = time.Second * 30
+
+// occupancySnapshot is the occupancy of an area after a booking event. Location is used to match the
+// streams of sites
+type occupancySnapshot struct {
+	OccupancyUpdate
+	Location string
+}
+
+// occupancyFeed computes the occupancy once per booking event and distributes it to all open streams, so
+// the number of open dashboards does not multiply the database queries
+type occupancyFeed struct {
+	mu    sync.RWMutex
+	subs  map[chan occupancySnapshot]struct{}
+	start sync.Once
+}
+
+var occupancy = &occupancyFeed{subs: make(map[chan occupancySnapshot]struct{})}
+
+// subscribe returns a channel receiving the occupancy after every booking event. the feed listens to the
+// event bus from the first subscription on
+func (f *occupancyFeed) subscribe(buffer int) chan occupancySnapshot {
+	f.start.Do(func() {
+		go f.run(events.subscribe(64))
+	})
+	ch := make(chan occupancySnapshot, buffer)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes the subscription and closes the channel
+func (f *occupancyFeed) unsubscribe(ch chan occupancySnapshot) {
+	f.mu.Lock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+	f.mu.Unlock()
+}
+
+func (f *occupancyFeed) run(ch chan Event) {
+	for e := range ch {
+		if e.Type != EventBookingCreated && e.Type != EventBookingDeleted {
+			continue
+		}
+		f.mu.RLock()
+		n := len(f.subs)
+		f.mu.RUnlock()
+		if n == 0 {
+			continue
+		}
+		s := occupancySnapshot{OccupancyUpdate: OccupancyUpdate{
+			Event:       e.Type,
+			Area:        e.Area,
+			Date:        e.Date,
+			BookedSeats: getBookingsForDate(e.Area, e.Date),
+		}}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		a, ok, err := cachedAreas.get(ctx, e.Area)
+		cancel()
+		if err != nil {
+			logrus.Error(err)
+		} else if ok {
+			s.Capacity = a.Capacity
+			s.Location = a.Location
+		}
+		f.publish(s)
+	}
+}
+
+// publish sends the snapshot to all streams. slow streams do not block the others, the snapshot is dropped
+// for them instead
+func (f *occupancyFeed) publish(s occupancySnapshot) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for ch := range f.subs {
+		select {
+		case ch <- s:
+		default:
+			logrus.WithField("area", s.Area).Warn("occupancy stream is too slow. dropping update")
+		}
+	}
+}
+
+// streamToken lets the browser EventSource, which cannot set the Authorization header, pass the firebase
+// id token as token query parameter. it has to run before the auth middleware. the id token expires after an
+// hour, so the client has to reconnect with a fresh one
+func streamToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t := c.Query("token"); t != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Token "+t)
+		}
+	}
+}
+
+// streamAreaOccupancy pushes the occupancy of a single area as server sent events
+func streamAreaOccupancy(c *gin.Context) {
+	a := c.Param("id")
+	logrus.WithField("area", a).Debug("starting occupancy stream for area")
+	streamOccupancy(c, func(s occupancySnapshot) bool {
+		return s.Area == a
+	})
+}
+
+// streamSiteOccupancy pushes the occupancy of all areas of a location as server sent events
+func streamSiteOccupancy(c *gin.Context) {
+	l := c.Param("location")
+	logrus.WithField("location", l).Debug("starting occupancy stream for site")
+	streamOccupancy(c, func(s occupancySnapshot) bool {
+		return s.Location == l
+	})
+}
+
+// streamOccupancy sends an occupancy event for every snapshot accepted by the match function until the
+// client closes the connection
+func streamOccupancy(c *gin.Context, match func(s occupancySnapshot) bool) {
+	ch := occupancy.subscribe(32)
+	defer occupancy.unsubscribe(ch)
+	hb := time.NewTicker(occupancyHeartbeat)
+	defer hb.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-hb.C:
+			c.SSEvent("heartbeat", time.Now().Format(time.RFC3339))
+			return true
+		case s, ok := <-ch:
+			if !ok {
+				return false
+			}
+			if match(s) {
+				c.SSEvent("occupancy", s.OccupancyUpdate)
+			}
+			return true
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Page is the uniform envelope of all list endpoints
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      int64       `json:"total"`
+}
+
+// listOptions contains the pagination and sorting settings of a list request
+type listOptions struct {
+	Limit    int64
+	Skip     int64
+	Sort     bson.D
+	Envelope bool
+}
+
+// parseListOptions reads the limit, cursor, sort and envelope query parameters.
+// sortable maps the names of the sort parameter to the actual document fields.
+// without any of limit, cursor or envelope the request is handled in compatibility mode and returns the old
+// response shape without paging, so existing clients keep working
+func parseListOptions(c *gin.Context, sortable map[string]string, defaultSort string) (listOptions, []string) {
+	o := listOptions{}
+	errs := []string{}
+
+	ev := c.Query("envelope")
+	o.Envelope = ev == "yes" || ev == "true" || ev == "1" || c.Query("limit") != "" || c.Query("cursor") != ""
+
+	if o.Envelope {
+		o.Limit = defaultPageSize
+	}
+	if l := c.Query("limit"); l != "" {
+		limit, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			errs = append(errs, "limit must be in range 1 to "+strconv.Itoa(maxPageSize))
+		}
+		o.Limit = limit
+	}
+	if cur := c.Query("cursor"); cur != "" {
+		skip, err := decodeCursor(cur)
+		if err != nil {
+			errs = append(errs, "cursor is invalid")
+		}
+		o.Skip = skip
+	}
+
+	s := c.DefaultQuery("sort", defaultSort)
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+		dir := 1
+		if strings.HasPrefix(field, "-") {
+			dir = -1
+			field = strings.TrimPrefix(field, "-")
+		}
+		key, ok := sortable[field]
+		if !ok {
+			errs = append(errs, "cannot sort by "+field)
+			continue
+		}
+		o.Sort = append(o.Sort, bson.E{key, dir})
+	}
+	// always sort by id last, so the order of equal items is stable between two pages
+	hasID := false
+	for _, e := range o.Sort {
+		hasID = hasID || e.Key == "_id"
+	}
+	if !hasID {
+		o.Sort = append(o.Sort, bson.E{"_id", 1})
+	}
+
+	return o, errs
+}
+
+// findOptions converts the list options into options for a mongodb find query
+func (o listOptions) findOptions() *options.FindOptions {
+	fo := options.Find()
+	if len(o.Sort) > 0 {
+		fo.SetSort(o.Sort)
+	}
+	if o.Skip > 0 {
+		fo.SetSkip(o.Skip)
+	}
+	if o.Limit > 0 {
+		fo.SetLimit(o.Limit)
+	}
+	return fo
+}
+
+// nextCursor returns the cursor for the page after the current one or an empty string if there is none
+func (o listOptions) nextCursor(n int, total int64) string {
+	next := o.Skip + int64(n)
+	if o.Limit == 0 || next >= total {
+		return ""
+	}
+	return encodeCursor(next)
+}
+
+func encodeCursor(skip int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(skip, 10)))
+}
+
+func decodeCursor(cur string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cur)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// abortWithListErrors responds with a bad request if parsing the list parameters failed
+func abortWithListErrors(c *gin.Context, errs []string) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+		Code:   http.StatusBadRequest,
+		Errors: errs,
+	})
+	return true
+}
+
+// parseListFilter reads the from, to, area and user query parameters and turns them into a mongodb filter.
+// mailField is the document field holding the mail address of the user. if it is empty, filtering by user
+// is not supported. withEndDate matches documents spanning several days like visits, if any of their days is
+// in the range. the errors are meant to be returned to the client
+func parseListFilter(c *gin.Context, withArea bool, mailField string, withEndDate bool) (bson.D, []string) {
+	dateLayout := "2006-01-02"
+	f := bson.D{}
+	errs := []string{}
+	dr := bson.D{}
+	from, to := c.Query("from"), c.Query("to")
+	if from != "" {
+		if _, err := time.Parse(dateLayout, from); err != nil {
+			errs = append(errs, "could not parse from date. must be yyyy-mm-dd")
+		}
+		dr = append(dr, bson.E{"$gte", from})
+	}
+	if to != "" {
+		if _, err := time.Parse(dateLayout, to); err != nil {
+			errs = append(errs, "could not parse to date. must be yyyy-mm-dd")
+		}
+		dr = append(dr, bson.E{"$lte", to})
+	}
+	if withEndDate && len(dr) > 0 {
+		// an open end of the range matches every date
+		if to == "" {
+			to = "9999-12-31"
+		}
+		f = append(f, visitOverlapFilter(from, to)...)
+	} else if len(dr) > 0 {
+		f = append(f, bson.E{"date", dr})
+	}
+	if a := c.Query("area"); a != "" {
+		if !withArea {
+			errs = append(errs, "filtering by area is not supported for this endpoint")
+		}
+		f = append(f, bson.E{"area", a})
+	}
+	if u := c.Query("user"); u != "" {
+		if mailField == "" {
+			errs = append(errs, "filtering by user is not supported for this endpoint")
+		}
+		// users can be filtered by their mail address or by their firebase id
+		if strings.Contains(u, "@") {
+			f = append(f, bson.E{mailField, strings.ToLower(u)})
+		} else {
+			f = append(f, bson.E{"user", u})
+		}
+	}
+	return f, errs
+}
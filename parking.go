@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errNoParkingSpace is returned if all matching parking spaces are taken on the date
+var errNoParkingSpace = errors.New("no parking space available")
+
+// ParkingLot is a car park of a site with a fixed set of spaces
+type ParkingLot struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Name     string             `bson:"name" json:"name"`
+	Location string             `bson:"location" json:"location"`
+	Address  string             `bson:"address" json:"address"`
+	Spaces   []ParkingSpace     `bson:"spaces" json:"spaces"`
+}
+
+// ParkingSpace is a single space of a parking lot. spaces reserved for visitors cannot be booked by employees
+type ParkingSpace struct {
+	Label       string `bson:"label" json:"label"`
+	ForVisitors bool   `bson:"for_visitors" json:"for_visitors"`
+}
+
+// ParkingBooking reserves a space of a parking lot for a single day. either User or Visit is set
+type ParkingBooking struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	Lot       primitive.ObjectID  `bson:"lot" json:"lot"`
+	Space     string              `bson:"space" json:"space"`
+	Date      string              `bson:"date" json:"date"`
+	User      string              `bson:"user,omitempty" json:"user,omitempty"`
+	UserName  string              `bson:"user_name,omitempty" json:"user_name,omitempty"`
+	Visit     *primitive.ObjectID `bson:"visit,omitempty" json:"visit,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// ParkingAssignment is the parking space of a guest as stored on the visit. the guest keeps the same space
+// on every day of the visit, so there is one booking per day
+type ParkingAssignment struct {
+	Bookings []primitive.ObjectID `bson:"bookings" json:"bookings"`
+	Lot      primitive.ObjectID   `bson:"lot" json:"lot"`
+	LotName  string               `bson:"lot_name" json:"lot_name"`
+	Address  string               `bson:"address" json:"address"`
+	Space    string               `bson:"space" json:"space"`
+}
+
+// AddParkingBookingRequest books a space for the employee. without a space the first free one is assigned
+type AddParkingBookingRequest struct {
+	Lot   string `json:"lot"`
+	Space string `json:"space"`
+	Date  string `json:"date"`
+}
+
+// ensureParkingIndexes makes sure a space can only be booked once per day, even if two requests race
+func ensureParkingIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	_, err := client.Database("office_checkin").Collection("parking_bookings").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"lot", 1}, {"space", 1}, {"date", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func findParkingLots(ctx context.Context, f bson.D) ([]ParkingLot, error) {
+	cur, err := client.Database("office_checkin").Collection("parking_lots").Find(ctx, f, options.Find().SetSort(bson.D{{"name", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	lots := []ParkingLot{}
+	err = cur.All(ctx, &lots)
+	return lots, err
+}
+
+// takenParkingSpaces returns the spaces of the lots booked on at least one of the dates, keyed by lot and space label
+func takenParkingSpaces(ctx context.Context, lots []ParkingLot, dates ...string) (map[primitive.ObjectID]map[string]bool, error) {
+	ids := bson.A{}
+	for _, l := range lots {
+		ids = append(ids, l.ID)
+	}
+	f := bson.D{{"lot", bson.D{{"$in", ids}}}, {"date", bson.D{{"$in", dates}}}}
+	cur, err := client.Database("office_checkin").Collection("parking_bookings").Find(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	var bookings []ParkingBooking
+	if err := cur.All(ctx, &bookings); err != nil {
+		return nil, err
+	}
+	taken := make(map[primitive.ObjectID]map[string]bool, len(lots))
+	for _, b := range bookings {
+		if taken[b.Lot] == nil {
+			taken[b.Lot] = make(map[string]bool)
+		}
+		taken[b.Lot][b.Space] = true
+	}
+	return taken, nil
+}
+
+// reserveParkingSpace books the first space of the lots accepted by the match function, which is free on all
+// dates. the unique index decides if two requests try to book the same space, in this case the bookings
+// already made for the space are removed again and the next free space is tried
+func reserveParkingSpace(ctx context.Context, lots []ParkingLot, pb ParkingBooking, dates []string, match func(s ParkingSpace) bool) ([]ParkingBooking, ParkingLot, error) {
+	taken, err := takenParkingSpaces(ctx, lots, dates...)
+	if err != nil {
+		return nil, ParkingLot{}, err
+	}
+	coll := client.Database("office_checkin").Collection("parking_bookings")
+	for _, l := range lots {
+	spaces:
+		for _, s := range l.Spaces {
+			if taken[l.ID][s.Label] || !match(s) {
+				continue
+			}
+			bookings := make([]ParkingBooking, 0, len(dates))
+			for _, d := range dates {
+				b := pb
+				b.ID = primitive.NewObjectID()
+				b.Lot = l.ID
+				b.Space = s.Label
+				b.Date = d
+				b.CreatedAt = time.Now()
+				_, err := coll.InsertOne(ctx, b)
+				if err != nil {
+					for _, ob := range bookings {
+						if _, err := coll.DeleteOne(ctx, bson.D{{"_id", ob.ID}}); err != nil {
+							logrus.Error(err)
+						}
+					}
+					if mongo.IsDuplicateKeyError(err) {
+						continue spaces
+					}
+					return nil, l, err
+				}
+				bookings = append(bookings, b)
+			}
+			return bookings, l, nil
+		}
+	}
+	return nil, ParkingLot{}, errNoParkingSpace
+}
+
+// assignVisitorParking reserves a parking space at the site of the visit. spaces reserved for visitors are
+// used first, after that the guest may get any free space
+func assignVisitorParking(ctx context.Context, v *Visit) error {
+	lots, err := findParkingLots(ctx, bson.D{{"location", v.Site}})
+	if err != nil {
+		return err
+	}
+	id := v.ID
+	pb := ParkingBooking{UserName: v.Visitor.FirstName + " " + v.Visitor.LastName, Visit: &id}
+	dates := v.dates()
+	b, l, err := reserveParkingSpace(ctx, lots, pb, dates, func(s ParkingSpace) bool { return s.ForVisitors })
+	if err == errNoParkingSpace {
+		b, l, err = reserveParkingSpace(ctx, lots, pb, dates, func(s ParkingSpace) bool { return true })
+	}
+	if err != nil {
+		return err
+	}
+	p := &ParkingAssignment{Lot: l.ID, LotName: l.Name, Address: l.Address, Space: b[0].Space}
+	for _, pb := range b {
+		p.Bookings = append(p.Bookings, pb.ID)
+	}
+	v.Parking = p
+	return nil
+}
+
+// releaseParking removes the parking bookings of a guest
+func releaseParking(ctx context.Context, p *ParkingAssignment) {
+	if p == nil || len(p.Bookings) == 0 {
+		return
+	}
+	f := bson.D{{"_id", bson.D{{"$in", p.Bookings}}}}
+	if _, err := client.Database("office_checkin").Collection("parking_bookings").DeleteMany(ctx, f); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// parkingConflictError is returned if no space can be assigned
+var parkingConflictError = ErrorResponse{
+	Code:   http.StatusConflict,
+	Errors: []string{"there is no free parking space on this date"},
+}
+
+func getParkingLots(c *gin.Context) {
+	f := bson.D{}
+	if l := c.Query("location"); l != "" {
+		f = append(f, bson.E{"location", l})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	lots, err := findParkingLots(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, lots)
+}
+
+// getParkingAvailability lists the free spaces of a parking lot on the date given by the date query parameter
+func getParkingAvailability(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"object id is not in proper format"},
+		})
+		return
+	}
+	date := c.Query("date")
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"date malformed. must be yyyy-mm-dd"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	lots, err := findParkingLots(ctx, bson.D{{"_id", oid}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if len(lots) == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the parking lot could not be found"},
+		})
+		return
+	}
+	taken, err := takenParkingSpaces(ctx, lots, date)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	free := []ParkingSpace{}
+	for _, s := range lots[0].Spaces {
+		if !taken[oid][s.Label] {
+			free = append(free, s)
+		}
+	}
+	c.JSON(http.StatusOK, struct {
+		Date       string         `json:"date"`
+		Capacity   int            `json:"capacity"`
+		FreeSpaces []ParkingSpace `json:"free_spaces"`
+	}{
+		Date:       date,
+		Capacity:   len(lots[0].Spaces),
+		FreeSpaces: free,
+	})
+}
+
+// getParkingBookings returns the upcoming parking bookings of the user
+func getParkingBookings(c *gin.Context) {
+	f := bson.D{{"user", c.GetString("userId")}, {"date", bson.D{{"$gte", time.Now().Format("2006-01-02")}}}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	cur, err := client.Database("office_checkin").Collection("parking_bookings").Find(ctx, f, options.Find().SetSort(bson.D{{"date", 1}}))
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	bookings := []ParkingBooking{}
+	if err := cur.All(ctx, &bookings); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, bookings)
+}
+
+// addParkingBooking books a parking space for the employee. employees can book one space per day
+// and cannot use the spaces reserved for visitors
+func addParkingBooking(c *gin.Context) {
+	var r AddParkingBookingRequest
+	if err := c.BindJSON(&r); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed. could not parse JSON"},
+		})
+		return
+	}
+	errs := []string{}
+	lid, err := primitive.ObjectIDFromHex(r.Lot)
+	if err != nil {
+		errs = append(errs, "lot is not in proper format")
+	}
+	if d, err := time.Parse("2006-01-02", r.Date); err != nil {
+		errs = append(errs, "date malformed. must be yyyy-mm-dd")
+	} else if d.Before(time.Now().Truncate(time.Hour * 24)) {
+		errs = append(errs, "the date must not be in the past")
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	uid := c.GetString("userId")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	n, err := client.Database("office_checkin").Collection("parking_bookings").CountDocuments(ctx, bson.D{{"user", uid}, {"date", r.Date}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if n > 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"you already booked a parking space on this date"},
+		})
+		return
+	}
+	lots, err := findParkingLots(ctx, bson.D{{"_id", lid}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if len(lots) == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the parking lot could not be found"},
+		})
+		return
+	}
+
+	pb := ParkingBooking{User: uid, UserName: c.GetString("userDisplayName")}
+	b, _, err := reserveParkingSpace(ctx, lots, pb, []string{r.Date}, func(s ParkingSpace) bool {
+		return !s.ForVisitors && (r.Space == "" || strings.EqualFold(s.Label, r.Space))
+	})
+	if err != nil {
+		if err == errNoParkingSpace {
+			c.AbortWithStatusJSON(http.StatusConflict, parkingConflictError)
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusCreated, b[0])
+}
+
+func deleteParkingBooking(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"object id is not in proper format"},
+		})
+		return
+	}
+	f := bson.D{{"_id", oid}, {"user", c.GetString("userId")}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	r, err := client.Database("office_checkin").Collection("parking_bookings").DeleteOne(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		DeletedItems int64 `json:"deleted_items"`
+	}{
+		DeletedItems: r.DeletedCount,
+	})
+}
+
+// addParkingLot creates a parking lot. the labels of the spaces have to be unique within the lot
+func addParkingLot(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	var l ParkingLot
+	if err := c.BindJSON(&l); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed. could not parse JSON"},
+		})
+		return
+	}
+	errs := []string{}
+	if strings.TrimSpace(l.Name) == "" {
+		errs = append(errs, "name cannot be empty")
+	}
+	if strings.TrimSpace(l.Location) == "" {
+		errs = append(errs, "location cannot be empty")
+	}
+	if len(l.Spaces) == 0 {
+		errs = append(errs, "a parking lot needs at least 1 space")
+	}
+	labels := make(map[string]bool, len(l.Spaces))
+	for _, s := range l.Spaces {
+		if s.Label == "" || labels[strings.ToLower(s.Label)] {
+			errs = append(errs, "the labels of the spaces must not be empty and unique")
+			break
+		}
+		labels[strings.ToLower(s.Label)] = true
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	l.ID = primitive.NewObjectID()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := client.Database("office_checkin").Collection("parking_lots").InsertOne(ctx, l); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusCreated, l)
+}
+
+// deleteParkingLot removes a parking lot. lots with upcoming bookings cannot be deleted
+func deleteParkingLot(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"object id is not in proper format"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	f := bson.D{{"lot", oid}, {"date", bson.D{{"$gte", time.Now().Format("2006-01-02")}}}}
+	n, err := client.Database("office_checkin").Collection("parking_bookings").CountDocuments(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if n > 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"the parking lot still has upcoming bookings"},
+		})
+		return
+	}
+	r, err := client.Database("office_checkin").Collection("parking_lots").DeleteOne(ctx, bson.D{{"_id", oid}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		DeletedItems int64 `json:"deleted_items"`
+	}{
+		DeletedItems: r.DeletedCount,
+	})
+}
+
+// adminGetParkingBookingsForDate lists all parking bookings of employees and guests on the date
+func adminGetParkingBookingsForDate(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{"lot", 1}, {"space", 1}})
+	cur, err := client.Database("office_checkin").Collection("parking_bookings").Find(ctx, bson.D{{"date", c.Param("date")}}, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	bookings := []ParkingBooking{}
+	if err := cur.All(ctx, &bookings); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, bookings)
+}
@@ -9,18 +9,55 @@ import (
 	"time"
 )
 
+// visitorBadge is a single badge of a guest. guests of visits spanning several days get one badge per day
+type visitorBadge struct {
+	Visit Visit
+	Date  string
+}
+
+// badgesPerPage is the number of badges fitting on a single A4 page
+const badgesPerPage = 8
+
+// handlePrintRequest renders the badges of all guests on the date. with the until query parameter the badges
+// of every day up to this date are rendered
 func handlePrintRequest(c *gin.Context) {
 	if !c.GetBool("isAdmin") {
 		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
 		return
 	}
 
-	vb := getVisitorBookingsForDate(c.Param("date"))
-	if len(vb) == 0 {
+	from := c.Param("date")
+	until := c.DefaultQuery("until", from)
+	errs := []string{}
+	start, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		errs = append(errs, "date malformed. must be yyyy-mm-dd")
+	}
+	end, err := time.Parse("2006-01-02", until)
+	if err != nil || end.Before(start) {
+		errs = append(errs, "until must be a yyyy-mm-dd date not before the date")
+	} else if len(errs) == 0 && end.Sub(start) >= time.Hour*24*maxVisitDays {
+		errs = append(errs, "until must not be more than "+strconv.Itoa(maxVisitDays)+" days after the date")
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	dates := dateRange(from, until)
+	badges := []visitorBadge{}
+	for _, d := range dates {
+		for _, v := range getVisitorBookingsForDate(d) {
+			badges = append(badges, visitorBadge{Visit: v, Date: d})
+		}
+	}
+	if len(badges) == 0 {
 		c.Status(http.StatusNoContent)
 		return
 	}
-	pdf := renderPDF(vb)
+	pdf := renderPDF(badges)
 	c.Header("Content-Type", "application/pdf")
 	c.Writer.Write(pdf.GetBytesPdf())
 
@@ -28,25 +65,32 @@ func handlePrintRequest(c *gin.Context) {
 
 // renderPDF creates the actual pdf document, which is send to the user to print visitor cards.
 // this function needs accomodations to match e.g. CI/CD
-func renderPDF(vb []Visit) gopdf.GoPdf {
-	doc := gopdf.GoPdf{}
+func renderPDF(badges []visitorBadge) *gopdf.GoPdf {
+	doc := &gopdf.GoPdf{}
 	doc.Start(gopdf.Config{ PageSize: *gopdf.PageSizeA4 })
-	doc.AddPage()
 	err := doc.AddTTFFont("Roboto", "./assets/Roboto-Regular.ttf")
 	if err != nil {
 		logrus.Error(err)
 	}
 
-	doc.SetTextColor(getForegroundColor())
-
 	offsetY := 25
 
-	for i,v := range vb {
+	for i,b := range badges {
+		v := b.Visit
+		if i%badgesPerPage == 0 {
+			if i != 0 {
+				drawCutLines(doc)
+			}
+			doc.AddPage()
+			doc.SetTextColor(getForegroundColor())
+			offsetY = 25
+		}
+		n := i % badgesPerPage
 		offsetX := 8
-		if i%2 == 1 {
+		if n%2 == 1 {
 			offsetX = 300
 		}
-		if i%2 == 0 && i != 0 {
+		if n%2 == 0 && n != 0 {
 			offsetY += 175
 		}
 		doc.SetX(float64(offsetX))
@@ -74,25 +118,36 @@ func renderPDF(vb []Visit) gopdf.GoPdf {
 		doc.Text(v.Visitor.Company)
 		doc.Br(24)
 		doc.SetX(float64(offsetX))
-		doc.Text("Supervisor: " + v.Supervisor.DisplayName)
+		l := v.Visitor.Locale
+		doc.Text(translate(l, "badge.supervisor") + v.Supervisor.DisplayName)
 		doc.Br(18)
 		doc.SetX(float64(offsetX))
-		t,_ := time.Parse("2006-01-02", v.Date)
-		doc.Text("Gültig am: " + t.Format("02.01.2006"))
+		doc.Text(translate(l, "badge.valid_on") + formatDate(l, b.Date))
+		if v.Parking != nil {
+			doc.Br(14)
+			doc.SetX(float64(offsetX))
+			doc.Text(translate(l, "badge.parking") + v.Parking.LotName + ", " + v.Parking.Space)
+		}
 		doc.SetFont("Roboto", "", 8)
 		doc.Br(12)
 		doc.SetX(float64(offsetX))
 
-		doc.Text("Dieses Badge muss jederzeit gut sichtbar getragen werden.")
+		doc.Text(translate(l, "badge.notice"))
 	}
 
+	drawCutLines(doc)
+	return doc
+}
+
+// drawCutLines draws the dashed lines between the badges of the current page
+func drawCutLines(doc *gopdf.GoPdf) {
 	doc.SetLineType("dashed")
 	doc.Line(290, 0, 290, 1500)
 	doc.Line(0, 175, 1500, 175)
 	doc.Line(0, 350, 1500, 350)
 	doc.Line(0, 525, 1500, 525)
 	doc.Line(0, 700, 1500, 700)
-	return doc
+	doc.SetLineType("solid")
 }
 
 func getForegroundColor() (uint8, uint8, uint8) {
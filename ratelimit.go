@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter counts the requests per client ip in fixed time windows
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	clients map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	rl := &rateLimiter{limit: limit, window: window, clients: make(map[string]*rateWindow)}
+	go rl.cleanup()
+	return rl
+}
+
+// allow counts the request and reports whether the client is still below the limit
+func (rl *rateLimiter) allow(ip string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	w, ok := rl.clients[ip]
+	if !ok || now.Sub(w.start) >= rl.window {
+		w = &rateWindow{start: now}
+		rl.clients[ip] = w
+	}
+	w.count++
+	return w.count <= rl.limit
+}
+
+// cleanup removes expired windows, so the map does not grow with every client ever seen
+func (rl *rateLimiter) cleanup() {
+	for range time.Tick(rl.window) {
+		rl.mu.Lock()
+		for ip, w := range rl.clients {
+			if time.Since(w.start) >= rl.window {
+				delete(rl.clients, ip)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// rateLimit aborts requests of clients exceeding the limit of the rate limiter
+func rateLimit(rl *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			return
+		}
+		ip := clientIP(c)
+		if !rl.allow(ip) {
+			logrus.WithField("ip", ip).Warn("rate limit exceeded")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusTooManyRequests,
+				Errors: []string{"too many requests. please try again later"},
+			}))
+			return
+		}
+	}
+}
+
+// clientIP returns the ip of the client. the X-Forwarded-For header is set by the client itself, so it is
+// only used if the request comes from one of the trusted proxies of the config. the header is read from the
+// right, because only the entries appended by the trusted proxies can be relied on
+func clientIP(c *gin.Context) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(forwarded[i])
+		if f == "" {
+			break
+		}
+		ip = f
+		if !isTrustedProxy(f) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether the ip matches one of the ips or cidr ranges in service.trusted_proxies
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range cfg.Service.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(addr) {
+				return true
+			}
+		} else if t := net.ParseIP(p); t != nil && t.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	qrcode "github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"time"
+)
+
+// checkInQRCodeID is the content id of the qr code in the invitation mail
+const checkInQRCodeID = "check-in-qr"
+
+// checkInQRCode creates the png shown at the reception. it contains the invitation token of the guest
+func checkInQRCode(token string) ([]byte, error) {
+	return qrcode.Encode(token, qrcode.Medium, 256)
+}
+
+// CheckInRequest is sent by the reception after scanning the qr code of the guest
+type CheckInRequest struct {
+	Token string `json:"token"`
+}
+
+// PresentVisitor is a guest currently in the building
+type PresentVisitor struct {
+	VisitID     string     `json:"visit_id"`
+	FirstName   string     `json:"first_name"`
+	LastName    string     `json:"last_name"`
+	Company     string     `json:"company"`
+	Phone       string     `json:"phone"`
+	Supervisor  Supervisor `json:"supervisor"`
+	CheckedInAt time.Time  `json:"checked_in_at"`
+}
+
+// checkInVisitor registers the arrival of the guest. guests can only be checked in on the days of the visit
+// and not twice a day without checking out in between
+func checkInVisitor(c *gin.Context) {
+	now := time.Now()
+	// guests of visits spanning several days check in every day, even if they forgot to check out the day before
+	f := bson.D{
+		{"$or", bson.A{
+			bson.D{{"checkedinat", nil}},
+			bson.D{{"checkedinat", bson.D{{"$lt", startOfDay(now)}}}},
+			bson.D{{"checkedoutat", bson.D{{"$ne", nil}}}},
+		}},
+	}
+	update := bson.M{"$set": bson.M{
+		"checkedinat":  now,
+		"checkedoutat": nil,
+		"checkedinby":  c.GetString("userMail"),
+	}}
+	v, ok := updateVisitAtReception(c, f, update, "the visitor is already checked in")
+	if !ok {
+		return
+	}
+	events.publish(Event{Type: EventVisitCheckedIn, Date: v.Date, Data: v})
+	if err := notifyHostAboutArrival(v, now); err != nil {
+		logrus.Error(err)
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// checkOutVisitor registers that the guest has left the building
+func checkOutVisitor(c *gin.Context) {
+	f := bson.D{
+		{"checkedinat", bson.D{{"$ne", nil}}},
+		{"checkedoutat", nil},
+	}
+	update := bson.M{"$set": bson.M{"checkedoutat": time.Now()}}
+	v, ok := updateVisitAtReception(c, f, update, "the visitor is not checked in")
+	if !ok {
+		return
+	}
+	events.publish(Event{Type: EventVisitCheckedOut, Date: v.Date, Data: v})
+	c.JSON(http.StatusOK, v)
+}
+
+// updateVisitAtReception applies the update to the visit of the scanned token if the visit also matches the
+// given filter. conflict is returned to the client if the visit exists but does not match the filter
+func updateVisitAtReception(c *gin.Context, f bson.D, update bson.M, conflict string) (v Visit, ok bool) {
+	if !c.GetBool("isReception") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	var r CheckInRequest
+	if err := c.ShouldBindJSON(&r); err != nil || r.Token == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	visit, err := findVisitByInvitationToken(ctx, r.Token)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if today := time.Now().Format("2006-01-02"); visit.Date > today || visit.lastDate() < today {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"the visit is not scheduled for today", "scheduled date: " + visit.Date},
+		})
+		return
+	}
+	// a declined visit has given up its capacity and parking space, so the guest is not expected anymore.
+	// guests who have not answered the invitation yet are still let in, the reception sees the status in the
+	// response. a guest who is already in the building can always be checked out
+	present := visit.CheckedInAt != nil && visit.CheckedOutAt == nil
+	if visit.InvitationStatus == InvitationStatusDeclined && !present {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"the guest has declined the invitation"},
+		})
+		return
+	}
+
+	f = append(bson.D{{"_id", visit.ID}}, f...)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = client.Database("office_checkin").Collection("visits").FindOneAndUpdate(ctx, f, update, opts).Decode(&v)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+				Code:   http.StatusConflict,
+				Errors: []string{conflict},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	return v, true
+}
+
+// getPresentVisitors lists all guests who are checked in and have not left yet. the list is meant to be used
+// in case of an evacuation, so it only contains what is needed to account for every guest
+func getPresentVisitors(c *gin.Context) {
+	if !c.GetBool("isReception") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	f := append(visitOnDateFilter(time.Now().Format("2006-01-02")),
+		bson.E{"checkedinat", bson.D{{"$gte", startOfDay(time.Now())}}},
+		bson.E{"checkedoutat", nil},
+	)
+	opts := options.Find().SetSort(bson.D{{"checkedinat", 1}})
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	var visits []Visit
+	if err := cur.All(ctx, &visits); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	res := make([]PresentVisitor, 0, len(visits))
+	for _, v := range visits {
+		res = append(res, PresentVisitor{
+			VisitID:     v.ID.Hex(),
+			FirstName:   v.Visitor.FirstName,
+			LastName:    v.Visitor.LastName,
+			Company:     v.Visitor.Company,
+			Phone:       v.Visitor.Phone,
+			Supervisor:  v.Supervisor,
+			CheckedInAt: *v.CheckedInAt,
+		})
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// startOfDay returns midnight of the day in the local time zone
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
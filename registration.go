@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/signintech/gopdf"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LegalDocument is a single version of a document guests have to accept, e.g. the privacy notice or an NDA.
+// versions are never changed, a new version is created instead, so every acceptance can be traced back
+type LegalDocument struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Key      string             `bson:"key" json:"key"`
+	Version  int                `bson:"version" json:"version"`
+	Required bool               `bson:"required" json:"required"`
+	// Texts contains the title and content of the document keyed by locale
+	Texts     map[string]LegalDocumentText `bson:"texts" json:"texts"`
+	Active    bool                         `bson:"active" json:"active"`
+	CreatedBy string                       `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time                    `bson:"created_at" json:"created_at"`
+}
+
+// LegalDocumentText is the translation of a document
+type LegalDocumentText struct {
+	Title   string `bson:"title" json:"title"`
+	Content string `bson:"content" json:"content"`
+}
+
+// text returns the translation of the document matching the locale best
+func (d LegalDocument) text(locale string) (string, LegalDocumentText) {
+	for _, l := range localeChain(locale) {
+		if t, ok := d.Texts[l]; ok {
+			return l, t
+		}
+	}
+	for l, t := range d.Texts {
+		return l, t
+	}
+	return "", LegalDocumentText{}
+}
+
+// GuestDocument is a document as shown to the guest in its language
+type GuestDocument struct {
+	Key      string `json:"key"`
+	Version  int    `json:"version"`
+	Required bool   `json:"required"`
+	Locale   string `json:"locale"`
+	Title    string `json:"title"`
+	Content  string `json:"content"`
+}
+
+// VisitorRegistration contains the data the guest entered during the pre-registration
+type VisitorRegistration struct {
+	Phone        string               `bson:"phone" json:"phone"`
+	Company      string               `bson:"company" json:"company"`
+	LicensePlate string               `bson:"license_plate" json:"license_plate"`
+	Acceptances  []DocumentAcceptance `bson:"acceptances" json:"acceptances"`
+	CompletedAt  time.Time            `bson:"completed_at" json:"completed_at"`
+}
+
+// DocumentAcceptance records that the guest accepted a version of a document. the hash of the shown text is
+// stored, so the record stays meaningful even if the document is removed later
+type DocumentAcceptance struct {
+	Key        string    `bson:"key" json:"key"`
+	Version    int       `bson:"version" json:"version"`
+	Locale     string    `bson:"locale" json:"locale"`
+	Title      string    `bson:"title" json:"title"`
+	Hash       string    `bson:"hash" json:"hash"`
+	AcceptedAt time.Time `bson:"accepted_at" json:"accepted_at"`
+	IP         string    `bson:"ip" json:"ip"`
+	UserAgent  string    `bson:"user_agent" json:"user_agent"`
+}
+
+// RegistrationRequest is sent by the guest with the pre-registration form
+type RegistrationRequest struct {
+	Phone             string `json:"phone"`
+	Company           string `json:"company"`
+	LicensePlate      string `json:"license_plate"`
+	AcceptedDocuments []struct {
+		Key     string `json:"key"`
+		Version int    `json:"version"`
+	} `json:"accepted_documents"`
+}
+
+var licensePlatePattern = regexp.MustCompile(`^[\p{L}0-9][\p{L}0-9 -]{0,14}$`)
+
+// currentDocuments returns the latest active version of every document
+func currentDocuments(ctx context.Context) ([]LegalDocument, error) {
+	opts := options.Find().SetSort(bson.D{{"key", 1}, {"version", -1}})
+	cur, err := client.Database("office_checkin").Collection("legal_documents").Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var all []LegalDocument
+	if err := cur.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	docs := []LegalDocument{}
+	seen := make(map[string]bool)
+	for _, d := range all {
+		if seen[d.Key] {
+			continue
+		}
+		// only the latest version of a key counts, so deactivating it removes the document
+		seen[d.Key] = true
+		if d.Active {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// hashDocumentText returns the sha256 hash of the title and content shown to the guest
+func hashDocumentText(t LegalDocumentText) string {
+	h := sha256.Sum256([]byte(t.Title + "\n" + t.Content))
+	return hex.EncodeToString(h[:])
+}
+
+// getInvitationDocuments lists the documents the guest has to read during the pre-registration
+func getInvitationDocuments(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	visit, err := findVisitByInvitationToken(ctx, c.Param("id"))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	docs, err := currentDocuments(ctx)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	locale := requestLocale(c)
+	if locale == "" {
+		locale = visit.Visitor.Locale
+	}
+	res := make([]GuestDocument, 0, len(docs))
+	for _, d := range docs {
+		l, t := d.text(locale)
+		res = append(res, GuestDocument{Key: d.Key, Version: d.Version, Required: d.Required, Locale: l, Title: t.Title, Content: t.Content})
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// submitRegistration stores the pre-registration of the guest. all required documents have to be accepted
+// in their current version. the guest may submit the form again, e.g. to correct the license plate
+func submitRegistration(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	token := c.Param("id")
+	visit, err := findVisitByInvitationToken(ctx, token)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	var r RegistrationRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		logrus.Info(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, localizeErrors(c, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		}))
+		return
+	}
+
+	reg := VisitorRegistration{
+		Phone:        strings.TrimSpace(r.Phone),
+		Company:      strings.TrimSpace(r.Company),
+		LicensePlate: strings.ToUpper(strings.TrimSpace(r.LicensePlate)),
+		CompletedAt:  time.Now(),
+	}
+	if reg.Phone == "" {
+		reg.Phone = visit.Visitor.Phone
+	}
+	if reg.Company == "" {
+		reg.Company = visit.Visitor.Company
+	}
+	errs := []string{}
+	if reg.Phone == "" {
+		errs = append(errs, "phone cannot be empty")
+	}
+	if visit.NeedsParkingSpace && reg.LicensePlate == "" {
+		errs = append(errs, "license plate cannot be empty if a parking space is needed")
+	}
+	if reg.LicensePlate != "" && !licensePlatePattern.MatchString(reg.LicensePlate) {
+		errs = append(errs, "license plate malformed")
+	}
+
+	docs, err := currentDocuments(ctx)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	accepted := make(map[string]int, len(r.AcceptedDocuments))
+	for _, a := range r.AcceptedDocuments {
+		accepted[a.Key] = a.Version
+	}
+	locale := requestLocale(c)
+	if locale == "" {
+		locale = visit.Visitor.Locale
+	}
+	for _, d := range docs {
+		v, ok := accepted[d.Key]
+		if ok && v != d.Version {
+			errs = append(errs, "a document has changed. please read it again")
+			continue
+		}
+		if !ok {
+			if d.Required {
+				errs = append(errs, "all required documents have to be accepted")
+			}
+			continue
+		}
+		l, t := d.text(locale)
+		reg.Acceptances = append(reg.Acceptances, DocumentAcceptance{
+			Key:        d.Key,
+			Version:    d.Version,
+			Locale:     l,
+			Title:      t.Title,
+			Hash:       hashDocumentText(t),
+			AcceptedAt: reg.CompletedAt,
+			IP:         clientIP(c),
+			UserAgent:  c.Request.UserAgent(),
+		})
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, localizeErrors(c, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: uniqueStrings(errs),
+		}))
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"registration":    reg,
+		"visitor.phone":   reg.Phone,
+		"visitor.company": reg.Company,
+	}}
+	if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, invitationFilter(token), update); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	// keep the directory up to date, so the data does not have to be entered again for the next visit
+	vu := bson.M{"$set": bson.M{"phone": reg.Phone, "company": reg.Company, "updated_at": time.Now()}}
+	if _, err := client.Database("office_checkin").Collection("visitors").UpdateOne(ctx, bson.D{{"_id", visit.Visitor.ID}}, vu); err != nil {
+		logrus.Error(err)
+	}
+	c.JSON(http.StatusOK, reg)
+}
+
+// registrationMissing reports whether the guest still has to accept documents before accepting the invitation
+func registrationMissing(ctx context.Context, v Visit) (bool, error) {
+	docs, err := currentDocuments(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range docs {
+		if !d.Required {
+			continue
+		}
+		if v.Registration == nil {
+			return true, nil
+		}
+		found := false
+		for _, a := range v.Registration.Acceptances {
+			if a.Key == d.Key && a.Version == d.Version {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	res := []string{}
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func getLegalDocuments(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{"key", 1}, {"version", -1}})
+	cur, err := client.Database("office_checkin").Collection("legal_documents").Find(ctx, bson.D{}, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	docs := []LegalDocument{}
+	if err := cur.All(ctx, &docs); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, docs)
+}
+
+// addLegalDocument creates a new version of a document. guests who accepted an older version have to accept
+// the new version if they pre-register again. sending active false withdraws the document
+func addLegalDocument(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	var d LegalDocument
+	if err := c.BindJSON(&d); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		})
+		return
+	}
+	errs := []string{}
+	d.Key = strings.ToLower(strings.TrimSpace(d.Key))
+	if d.Key == "" {
+		errs = append(errs, "key cannot be empty")
+	}
+	if d.Active && len(d.Texts) == 0 {
+		errs = append(errs, "an active document needs at least 1 text")
+	}
+	texts := make(map[string]LegalDocumentText, len(d.Texts))
+	for l, t := range d.Texts {
+		l = normalizeLocale(l)
+		if !isSupportedLocale(l) {
+			errs = append(errs, "locale is not supported")
+		}
+		if strings.TrimSpace(t.Title) == "" || strings.TrimSpace(t.Content) == "" {
+			errs = append(errs, "title and content of a document cannot be empty")
+		}
+		texts[l] = t
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: uniqueStrings(errs),
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var latest LegalDocument
+	opts := options.FindOne().SetSort(bson.D{{"version", -1}})
+	err := client.Database("office_checkin").Collection("legal_documents").FindOne(ctx, bson.D{{"key", d.Key}}, opts).Decode(&latest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	d.ID = primitive.NewObjectID()
+	d.Version = latest.Version + 1
+	d.Texts = texts
+	d.CreatedBy = c.GetString("userMail")
+	d.CreatedAt = time.Now()
+	if _, err := client.Database("office_checkin").Collection("legal_documents").InsertOne(ctx, d); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusCreated, d)
+}
+
+// getAcceptanceRecord renders the pre-registration of a visit including all accepted documents as pdf
+func getAcceptanceRecord(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"visit id malformed"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var v Visit
+	if err := client.Database("office_checkin").Collection("visits").FindOne(ctx, bson.D{{"_id", oid}}).Decode(&v); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the visit could not be found"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if v.Registration == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the visitor has not completed the pre-registration"},
+		})
+		return
+	}
+	doc := renderAcceptanceRecord(v)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"acceptance-%s.pdf\"", v.ID.Hex()))
+	c.Data(http.StatusOK, "application/pdf", doc.GetBytesPdf())
+}
+
+// renderAcceptanceRecord creates the pdf listing the guest, the visit and every accepted document in the
+// language of the guest
+func renderAcceptanceRecord(v Visit) *gopdf.GoPdf {
+	doc := &gopdf.GoPdf{}
+	doc.Start(gopdf.Config{PageSize: *gopdf.PageSizeA4})
+	doc.AddPage()
+	if err := doc.AddTTFFont("Roboto", "./assets/Roboto-Regular.ttf"); err != nil {
+		logrus.Error(err)
+	}
+	line := func(size float64, text string, gap float64) {
+		if err := doc.SetFont("Roboto", "", size); err != nil {
+			logrus.Error(err)
+			return
+		}
+		if doc.GetY() > 800 {
+			doc.AddPage()
+			doc.SetY(40)
+		}
+		doc.SetX(40)
+		doc.Text(text)
+		doc.Br(gap)
+	}
+	r := v.Registration
+	l := v.Visitor.Locale
+	t := func(key string) string {
+		return translate(l, key)
+	}
+	timeFormat := t("record.time.format")
+	doc.SetY(50)
+	line(18, t("record.title"), 30)
+	line(11, t("record.visit")+v.ID.Hex(), 16)
+	line(11, t("record.date")+formatDateRange(l, v), 16)
+	line(11, t("record.site")+v.Site, 16)
+	line(11, t("record.supervisor")+v.Supervisor.DisplayName+" <"+v.Supervisor.Email+">", 24)
+	line(11, t("record.guest")+v.Visitor.FirstName+" "+v.Visitor.LastName+" <"+v.Visitor.Email+">", 16)
+	line(11, t("record.company")+r.Company, 16)
+	line(11, t("record.phone")+r.Phone, 16)
+	line(11, t("record.license_plate")+r.LicensePlate, 16)
+	line(11, t("record.registered_at")+r.CompletedAt.Format(timeFormat), 30)
+	line(14, t("record.documents"), 22)
+	if len(r.Acceptances) == 0 {
+		line(11, t("record.no_documents"), 16)
+	}
+	for _, a := range r.Acceptances {
+		line(11, fmt.Sprintf(t("record.document"), a.Title, a.Key, a.Version, a.Locale), 16)
+		line(9, fmt.Sprintf(t("record.accepted"), a.AcceptedAt.Format(timeFormat), a.IP), 13)
+		line(9, t("record.browser")+a.UserAgent, 13)
+		line(9, "SHA-256: "+a.Hash, 22)
+	}
+	return doc
+}
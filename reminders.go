@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"time"
+)
+
+// bookingCancellationLookups limits the lookups of cancel tokens per client, so tokens cannot be guessed
+var bookingCancellationLookups = newRateLimiter(30, time.Minute)
+
+// sendBookingReminders reminds every employee of the booking of tomorrow. the mail contains a link to cancel
+// the booking without logging in. the reminders are sent once a day after the reminder hour of the employee
+func sendBookingReminders() error {
+	if !cfg.Notifications.BookingReminders {
+		return nil
+	}
+	now := time.Now()
+	tomorrow := now.Add(time.Hour * 24).Format("2006-01-02")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	f := bson.D{{"date", tomorrow}, {"remindersent", bson.D{{"$ne", true}}}}
+	cur, err := client.Database("office_checkin").Collection("bookings").Find(ctx, f)
+	if err != nil {
+		return err
+	}
+	var bookings []struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Booking `bson:",inline"`
+	}
+	if err := cur.All(ctx, &bookings); err != nil {
+		return err
+	}
+	if len(bookings) == 0 {
+		return nil
+	}
+	uids := bson.A{}
+	for _, b := range bookings {
+		uids = append(uids, b.User)
+	}
+	users, err := findUsers(ctx, bson.D{{"firebaseid", bson.D{{"$in", uids}}}})
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"date": tomorrow, "bookings": len(bookings)}).Info("sending booking reminders")
+
+	failed := 0
+	for _, b := range bookings {
+		u, ok := users[b.User]
+		if !ok || u.Email == "" {
+			continue
+		}
+		p := u.notificationPreferences()
+		if now.Hour() < p.reminderHour(cfg.Notifications.BookingReminderHour) {
+			continue
+		}
+		coll := client.Database("office_checkin").Collection("bookings")
+		if !p.wants(notificationBookingReminder, channelMail) {
+			if _, err := coll.UpdateOne(ctx, bson.D{{"_id", b.ID}}, bson.M{"$set": bson.M{"remindersent": true}}); err != nil {
+				logrus.Error(err)
+			}
+			continue
+		}
+		token, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		date, _ := time.Parse("2006-01-02", b.Date)
+		update := bson.M{"$set": bson.M{
+			"remindersent":         true,
+			"canceltoken":          hashToken(token),
+			"canceltokenexpiresat": date.Add(time.Hour * 24),
+		}}
+		if _, err := coll.UpdateOne(ctx, bson.D{{"_id", b.ID}}, update); err != nil {
+			logrus.Error(err)
+			failed++
+			continue
+		}
+		area := b.AreaData
+		if a, ok, err := cachedAreas.get(ctx, b.Area); err == nil && ok {
+			area = a
+		}
+		err = queueMail(u.Locale, u.Email, u.FirstName+" "+u.LastName, "booking-reminder", struct {
+			Name    string
+			Date    string
+			Area    string
+			Address string
+			Token   string
+		}{
+			Name:    u.FirstName,
+			Date:    formatDate(u.Locale, b.Date),
+			Area:    area.Name,
+			Address: area.Address,
+			Token:   token,
+		})
+		if err != nil {
+			logrus.Error(err)
+			failed++
+			// try again with the next run
+			if _, err := coll.UpdateOne(ctx, bson.D{{"_id", b.ID}}, bson.M{"$set": bson.M{"remindersent": false}}); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not send %d booking reminders", failed)
+	}
+	return nil
+}
+
+// sendGuestInvitationReminders reminds guests who did not answer their invitation GuestReminderDays days
+// before the visit. only the hash of the invitation token is known, so the reminder contains a new link and
+// qr code, which replace the ones of the invitation mail. guests invited less than a day ago are not
+// reminded yet
+func sendGuestInvitationReminders() error {
+	days := cfg.Notifications.GuestReminderDays
+	if days <= 0 {
+		return nil
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	f := bson.D{
+		{"date", bson.D{
+			{"$gt", now.Format("2006-01-02")},
+			{"$lte", now.AddDate(0, 0, days).Format("2006-01-02")},
+		}},
+		{"_id", bson.D{{"$lt", primitive.NewObjectIDFromTimestamp(now.Add(-time.Hour * 24))}}},
+		{"hasaccepted", bson.D{{"$ne", true}}},
+		{"invitationstatus", bson.D{{"$nin", bson.A{InvitationStatusAccepted, InvitationStatusDeclined, InvitationStatusDateProposed}}}},
+		{"guestremindersent", bson.D{{"$ne", true}}},
+		{"visitor.reminder_opt_out", bson.D{{"$ne", true}}},
+	}
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
+	if err != nil {
+		return err
+	}
+	var visits []Visit
+	if err := cur.All(ctx, &visits); err != nil {
+		return err
+	}
+	if len(visits) == 0 {
+		return nil
+	}
+	logrus.WithField("visits", len(visits)).Info("sending invitation reminders to guests")
+
+	failed := 0
+	for _, v := range visits {
+		// the invitation token is only stored as hash, so the reminder gets a new link like a resent
+		// invitation. this revokes the link and qr code of the invitation mail
+		token, err := newInvitationToken(&v)
+		if err != nil {
+			return err
+		}
+		// the opt-out link gets a token of its own, so it cannot be used to answer the invitation
+		optOutToken, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{
+			"invitationtoken":     v.InvitationToken,
+			"invitationexpiresat": v.InvitationExpiresAt,
+			"reminderoptouttoken": hashToken(optOutToken),
+			"guestremindersent":   true,
+		}}
+		if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, bson.D{{"_id", v.ID}}, update); err != nil {
+			logrus.Error(err)
+			failed++
+			continue
+		}
+		if err := sendInvitationReminderMail(v, token, optOutToken); err != nil {
+			logrus.Error(err)
+			failed++
+			// the link of the invitation mail has been revoked, so the next run has to try again
+			if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, bson.D{{"_id", v.ID}}, bson.M{"$set": bson.M{"guestremindersent": false}}); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not send %d invitation reminders", failed)
+	}
+	return nil
+}
+
+// sendInvitationReminderMail queues the reminder for the guest of the visit. it contains the new invitation
+// link, calendar entry and qr code like the invitation, optOutToken is used in the opt-out link
+func sendInvitationReminderMail(v Visit, token, optOutToken string) error {
+	return sendVisitMail(v, token, optOutToken, "invitation-reminder")
+}
+
+// findUsers returns all users matching the filter keyed by their firebase id
+func findUsers(ctx context.Context, filter bson.D) (map[string]User, error) {
+	cur, err := client.Database("office_checkin").Collection("users").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var all []User
+	if err := cur.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	users := make(map[string]User, len(all))
+	for _, u := range all {
+		users[u.FirebaseID] = u
+	}
+	return users, nil
+}
+
+// bookingCancellationFilter matches the booking of a cancel token as long as the booked day has not passed
+func bookingCancellationFilter(token string) bson.D {
+	return bson.D{
+		{"canceltoken", hashToken(token)},
+		{"canceltokenexpiresat", bson.D{{"$gt", time.Now()}}},
+	}
+}
+
+// getBookingCancellation returns the booking of a cancel token, so it can be shown before cancelling it
+func getBookingCancellation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var b Booking
+	raw, err := client.Database("office_checkin").Collection("bookings").FindOne(ctx, bookingCancellationFilter(c.Param("token"))).DecodeBytes()
+	if err == nil {
+		err = bson.Unmarshal(raw, &b)
+	}
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the booking does not exist anymore or the link has expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	b.ID = raw.Lookup("_id").ObjectID().Hex()
+	c.JSON(http.StatusOK, b)
+}
+
+// cancelBookingByToken deletes the booking of a cancel token. it is called by the page linked in the reminder
+// mail, so employees can release their place without logging in
+func cancelBookingByToken(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var b Booking
+	raw, err := client.Database("office_checkin").Collection("bookings").FindOneAndDelete(ctx, bookingCancellationFilter(c.Param("token"))).DecodeBytes()
+	if err == nil {
+		err = bson.Unmarshal(raw, &b)
+	}
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the booking does not exist anymore or the link has expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	b.ID = raw.Lookup("_id").ObjectID().Hex()
+	logrus.WithFields(logrus.Fields{"booking_id": b.ID, "user": b.User}).Info("booking cancelled from reminder mail")
+	events.publish(Event{Type: EventBookingDeleted, Area: b.Area, Date: b.Date, Data: b})
+	c.JSON(http.StatusOK, SuccessResponse{
+		Code:    http.StatusOK,
+		Message: "successfully deleted booking",
+	})
+}
+
+// optOutOfGuestReminders stops the invitation reminders for the guest of the invitation. the setting is stored
+// in the visitor directory, so it also applies to future invitations
+func optOutOfGuestReminders(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	v, err := findVisitByInvitationToken(ctx, c.Param("id"))
+	optOutOfGuestRemindersOfVisit(ctx, c, v, err)
+}
+
+// optOutOfGuestRemindersByToken stops the invitation reminders for the guest who received the reminder with
+// the opt-out token. it is called by the page linked in the reminder mail
+func optOutOfGuestRemindersByToken(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var v Visit
+	err := mongo.ErrNoDocuments
+	if token := c.Param("token"); token != "" {
+		f := bson.D{
+			{"reminderoptouttoken", hashToken(token)},
+			{"invitationexpiresat", bson.D{{"$gt", time.Now()}}},
+		}
+		err = client.Database("office_checkin").Collection("visits").FindOne(ctx, f).Decode(&v)
+	}
+	optOutOfGuestRemindersOfVisit(ctx, c, v, err)
+}
+
+// optOutOfGuestRemindersOfVisit stores the opt-out of the guest of the visit. err is the result of the lookup
+// of the visit
+func optOutOfGuestRemindersOfVisit(ctx context.Context, c *gin.Context, v Visit, err error) {
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	f := bson.D{{"_id", v.ID}}
+	if !v.Visitor.ID.IsZero() {
+		f = bson.D{{"visitor._id", v.Visitor.ID}}
+		if _, err := client.Database("office_checkin").Collection("visitors").UpdateOne(ctx, bson.D{{"_id", v.Visitor.ID}}, bson.M{"$set": bson.M{"reminder_opt_out": true}}); err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+			return
+		}
+	}
+	if _, err := client.Database("office_checkin").Collection("visits").UpdateMany(ctx, f, bson.M{"$set": bson.M{"visitor.reminder_opt_out": true}}); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	taskResultSuccess = "success"
+	taskResultFailed  = "failed"
+)
+
+// TaskStatus describes a background task and the result of its last run. the last run may have happened on
+// another instance, Runs and Failures only count the runs of this instance
+type TaskStatus struct {
+	Name     string `bson:"name" json:"name"`
+	Schedule string `bson:"schedule" json:"schedule"`
+	Running  bool   `bson:"running" json:"running"`
+	// LeaseOwner is the instance which holds or held the lease of the task
+	LeaseOwner string `bson:"lease_owner" json:"lease_owner,omitempty"`
+	// LastTrigger is schedule, startup or manual
+	LastTrigger  string    `bson:"last_trigger" json:"last_trigger,omitempty"`
+	LastStart    time.Time `bson:"last_start" json:"last_start,omitempty"`
+	LastDuration string    `bson:"last_duration" json:"last_duration,omitempty"`
+	LastResult   string    `bson:"last_result" json:"last_result,omitempty"`
+	LastError    string    `bson:"last_error" json:"last_error,omitempty"`
+	NextRun      time.Time `bson:"next_run" json:"next_run"`
+	Runs         int       `bson:"runs" json:"runs"`
+	Failures     int       `bson:"failures" json:"failures"`
+}
+
+// scheduledTask is a task registered at the scheduler. a task never runs twice at the same time, neither on
+// this instance nor on other replicas. runs which would overlap with a running one are skipped
+type scheduledTask struct {
+	name     string
+	schedule cron.Schedule
+	run      func() error
+	leases   leaseStore
+	owner    string
+
+	mu     sync.Mutex
+	status TaskStatus
+}
+
+// scheduler runs the background tasks according to their cron expressions
+type scheduler struct {
+	mu    sync.RWMutex
+	tasks []*scheduledTask
+	// leases is shared by all replicas. owner identifies this instance as holder of a lease
+	leases leaseStore
+	owner  string
+}
+
+var tasks = &scheduler{}
+
+// register adds a task. spec is a standard cron expression or a descriptor like @hourly or @every 15m.
+// a schedule configured in tasks.schedules replaces spec
+func (s *scheduler) register(name, spec string, run func() error) error {
+	if c, ok := cfg.Tasks.Schedules[name]; ok && c != "" {
+		spec = c
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for task %s: %w", spec, name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, &scheduledTask{
+		name:     name,
+		schedule: schedule,
+		run:      run,
+		leases:   s.leases,
+		owner:    s.owner,
+		status:   TaskStatus{Name: name, Schedule: spec},
+	})
+	return nil
+}
+
+// initialSlot is the slot of the very first run of a task, so only one replica runs it after the first deployment
+var initialSlot = time.Unix(0, 0)
+
+// maxMissedSlots limits the search for a missed slot after a long downtime
+const maxMissedSlots = 100000
+
+// start runs every task which missed a slot while the service was down and afterwards according to its schedule
+func (s *scheduler) start() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tasks {
+		go t.loop()
+	}
+}
+
+func (t *scheduledTask) loop() {
+	if slot, missed := t.missedSlot(); missed {
+		t.execute("startup", slot)
+	}
+	for {
+		next := t.next(time.Now())
+		t.mu.Lock()
+		t.status.NextRun = next
+		t.mu.Unlock()
+		time.Sleep(time.Until(next))
+		t.execute("schedule", next)
+	}
+}
+
+// next returns the next slot after from. @every schedules are aligned to multiples of their interval, so all
+// replicas calculate the same slots regardless of when they have been started
+func (t *scheduledTask) next(from time.Time) time.Time {
+	if d, ok := t.schedule.(cron.ConstantDelaySchedule); ok {
+		return from.Truncate(d.Delay).Add(d.Delay)
+	}
+	return t.schedule.Next(from)
+}
+
+// missedSlot returns the latest slot which passed since the last run of the task on any instance
+func (t *scheduledTask) missedSlot() (time.Time, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ls, err := t.leases.Leases(ctx)
+	if err != nil {
+		logrus.WithField("task", t.name).Error(err)
+		return time.Time{}, false
+	}
+	l, ok := ls[t.name]
+	if !ok || l.LastSlot.IsZero() {
+		return initialSlot, true
+	}
+	// slots before the start of the last run are not missed, even if the last run was the initial one
+	from := l.LastSlot
+	if l.AcquiredAt.After(from) {
+		from = l.AcquiredAt
+	}
+	now := time.Now()
+	slot, missed := from, false
+	for n, i := t.next(from), 0; !n.After(now) && i < maxMissedSlots; n, i = t.next(n), i+1 {
+		slot, missed = n, true
+	}
+	return slot, missed
+}
+
+// execute runs the task for the slot unless it is already running here or on another instance or the slot
+// has already been taken by another instance. it returns false if the run has been skipped
+func (t *scheduledTask) execute(trigger string, slot time.Time) bool {
+	log := logrus.WithFields(logrus.Fields{"task": t.name, "trigger": trigger})
+	t.mu.Lock()
+	if t.status.Running {
+		t.mu.Unlock()
+		log.Warn("skipping task, because it is still running")
+		return false
+	}
+	t.status.Running = true
+	t.mu.Unlock()
+
+	ttl := leaseTTL()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ok, owner, err := t.leases.Acquire(ctx, t.name, t.owner, slot, ttl)
+	cancel()
+	if err != nil || !ok {
+		t.mu.Lock()
+		t.status.Running = false
+		if err == nil {
+			t.status.LeaseOwner = owner
+		}
+		t.mu.Unlock()
+		if err != nil {
+			log.Error(err)
+		} else {
+			log.WithField("owner", owner).Debug("skipping task, because another instance holds the lease or already ran it")
+		}
+		return false
+	}
+
+	t.mu.Lock()
+	t.status.LeaseOwner = t.owner
+	t.status.LastTrigger = trigger
+	t.status.LastStart = time.Now()
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go t.renewLease(ttl, done)
+	err = t.safeRun()
+	close(done)
+
+	t.mu.Lock()
+	t.status.Running = false
+	t.status.LastDuration = time.Since(t.status.LastStart).Round(time.Millisecond).String()
+	t.status.Runs++
+	t.status.LastResult = taskResultSuccess
+	t.status.LastError = ""
+	if err != nil {
+		log.Error(err)
+		t.status.LastResult = taskResultFailed
+		t.status.LastError = err.Error()
+		t.status.Failures++
+	}
+	status := t.status
+	t.mu.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := t.leases.Release(ctx, t.name, t.owner, status); err != nil {
+		log.Error(err)
+	}
+	return true
+}
+
+// renewLease keeps the lease of a running task until done is closed
+func (t *scheduledTask) renewLease(ttl time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			ok, err := t.leases.Renew(ctx, t.name, t.owner, ttl)
+			cancel()
+			if err != nil {
+				logrus.WithField("task", t.name).Error(err)
+			} else if !ok {
+				logrus.WithField("task", t.name).Warn("lost the lease of a running task")
+			}
+		}
+	}
+}
+
+// safeRun keeps a panicking task from taking down the whole service
+func (t *scheduledTask) safeRun() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return t.run()
+}
+
+func (s *scheduler) find(name string) *scheduledTask {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tasks {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// statuses returns the status of every task including runs on other instances
+func (s *scheduler) statuses(ctx context.Context) ([]TaskStatus, error) {
+	ls, err := s.leases.Leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]TaskStatus, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		t.mu.Lock()
+		st := t.status
+		t.mu.Unlock()
+		if l, ok := ls[t.name]; ok {
+			if l.LastStatus.LastStart.After(st.LastStart) {
+				st.LastTrigger = l.LastStatus.LastTrigger
+				st.LastStart = l.LastStatus.LastStart
+				st.LastDuration = l.LastStatus.LastDuration
+				st.LastResult = l.LastStatus.LastResult
+				st.LastError = l.LastStatus.LastError
+			}
+			st.LeaseOwner = l.Owner
+			st.Running = st.Running || l.ExpiresAt.After(time.Now())
+		}
+		res = append(res, st)
+	}
+	return res, nil
+}
+
+func getTasks(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	statuses, err := tasks.statuses(ctx)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+// runTask starts a task immediately. the request does not wait for the task to finish
+func runTask(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	t := tasks.find(c.Param("name"))
+	if t == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the task could not be found"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ls, err := tasks.leases.Leases(ctx)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	t.mu.Lock()
+	running := t.status.Running || ls[t.name].ExpiresAt.After(time.Now())
+	t.mu.Unlock()
+	if running {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"the task is already running"},
+		})
+		return
+	}
+	logrus.WithFields(logrus.Fields{"task": t.name, "user": c.GetString("userMail")}).Info("task triggered manually")
+	go t.execute("manual", time.Now())
+	c.Status(http.StatusAccepted)
+}
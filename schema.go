@@ -81,3 +81,12 @@ type BacktracingItem struct {
 	Email    string `json:"email"`
 	AreaName string `json:"area_name"`
 }
+
+// OccupancyUpdate is pushed to the occupancy streams whenever the number of booked seats changes
+type OccupancyUpdate struct {
+	Event       string `json:"event"`
+	Area        string `json:"area"`
+	Date        string `json:"date"`
+	BookedSeats uint16 `json:"booked_seats"`
+	Capacity    uint16 `json:"capacity"`
+}
@@ -13,10 +13,12 @@ type Settings struct {
 	ID primitive.ObjectID `bson:"_id" ,json:"id"`
 	Key string `bson:"key" ,json:"key"`
 	LocationManagers []string `bson:"location_managers" ,json:"location_managers"`
+	ReceptionStaff []string `bson:"reception_staff" ,json:"reception_staff"`
 }
 
 var (
 	adminUsers map[string]bool
+	receptionUsers map[string]bool
 )
 
 func initSettings() {
@@ -33,9 +35,15 @@ func initSettings() {
 		adminUsers[user] = true
 		logrus.WithField("user_mail", user).Debug("adding location manager")
 	}
+	receptionUsers = make(map[string]bool, len(s.ReceptionStaff))
+	for _,user := range s.ReceptionStaff {
+		receptionUsers[user] = true
+		logrus.WithField("user_mail", user).Debug("adding reception staff")
+	}
 }
 
 func refreshSettingsHandler(c *gin.Context) {
 	initSettings()
+	cachedAreas.invalidate()
 	c.JSON(http.StatusOK, nil)
 }
\ No newline at end of file
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultLeaseTTL is used if tasks.lease_ttl is not set. a lease of a crashed instance expires after this time
+const defaultLeaseTTL = time.Minute * 2
+
+// TaskLease allows a single instance of the service to run a task. the owner renews the lease while the task
+// is running, so a lease only expires if the owner died. every scheduled slot can only be taken once, so
+// replicas whose timers fire a little later do not run the task again
+type TaskLease struct {
+	Task       string     `bson:"_id" json:"task"`
+	Owner      string     `bson:"owner" json:"owner"`
+	LastSlot   time.Time  `bson:"last_slot" json:"last_slot"`
+	AcquiredAt time.Time  `bson:"acquired_at" json:"acquired_at"`
+	ExpiresAt  time.Time  `bson:"expires_at" json:"expires_at"`
+	LastStatus TaskStatus `bson:"last_status" json:"last_status"`
+}
+
+// leaseStore hands out the task leases to the instances of the service
+type leaseStore interface {
+	// Acquire takes the lease for the slot if the lease is free, expired or already owned by owner and the
+	// slot has not been taken yet. otherwise the current owner is returned
+	Acquire(ctx context.Context, task, owner string, slot time.Time, ttl time.Duration) (bool, string, error)
+	// Renew extends a lease owned by owner. it returns false if the lease has been lost
+	Renew(ctx context.Context, task, owner string, ttl time.Duration) (bool, error)
+	// Release frees the lease and stores the status of the finished run
+	Release(ctx context.Context, task, owner string, status TaskStatus) error
+	// Leases returns all leases keyed by task
+	Leases(ctx context.Context) (map[string]TaskLease, error)
+}
+
+// initTaskLeases selects the lease store of the scheduler by the tasks lease_store setting and identifies this
+// instance of the service as owner of task leases
+func initTaskLeases() {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix, err := randomToken(4)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	store, err := newLeaseStore()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	tasks.leases, tasks.owner = store, host+"-"+suffix
+	logrus.WithFields(logrus.Fields{"store": fmt.Sprintf("%T", store), "instance": tasks.owner}).Info("initialized task leases")
+}
+
+func newLeaseStore() (leaseStore, error) {
+	switch cfg.Tasks.LeaseStore {
+	case "", "mongodb":
+		return &mongoLeaseStore{}, nil
+	case "memory":
+		return newMemoryLeaseStore(), nil
+	}
+	return nil, fmt.Errorf("unknown task lease store %s. must be mongodb or memory", cfg.Tasks.LeaseStore)
+}
+
+// leaseTTL returns the configured lifetime of a lease
+func leaseTTL() time.Duration {
+	if cfg.Tasks.LeaseTTL == "" {
+		return defaultLeaseTTL
+	}
+	ttl, err := time.ParseDuration(cfg.Tasks.LeaseTTL)
+	if err != nil || ttl < time.Second*10 {
+		logrus.Warnf("invalid task lease ttl %s. going to use default of %s", cfg.Tasks.LeaseTTL, defaultLeaseTTL)
+		return defaultLeaseTTL
+	}
+	return ttl
+}
+
+// mongoLeaseStore keeps the leases in the task_leases collection, so they are shared by all replicas
+type mongoLeaseStore struct{}
+
+func (s *mongoLeaseStore) collection() *mongo.Collection {
+	return client.Database("office_checkin").Collection("task_leases")
+}
+
+func (s *mongoLeaseStore) Acquire(ctx context.Context, task, owner string, slot time.Time, ttl time.Duration) (bool, string, error) {
+	now := time.Now()
+	f := bson.D{
+		{"_id", task},
+		{"last_slot", bson.D{{"$lt", slot}}},
+		{"$or", bson.A{
+			bson.D{{"expires_at", bson.D{{"$lte", now}}}},
+			bson.D{{"owner", owner}},
+		}},
+	}
+	update := bson.M{"$set": bson.M{"owner": owner, "last_slot": slot, "acquired_at": now, "expires_at": now.Add(ttl)}}
+	_, err := s.collection().UpdateOne(ctx, f, update, options.Update().SetUpsert(true))
+	if err == nil {
+		return true, owner, nil
+	}
+	// the upsert fails with a duplicate key if another instance holds the lease or the slot has been taken
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, "", err
+	}
+	var l TaskLease
+	if err := s.collection().FindOne(ctx, bson.D{{"_id", task}}).Decode(&l); err != nil {
+		return false, "", err
+	}
+	return false, l.Owner, nil
+}
+
+func (s *mongoLeaseStore) Renew(ctx context.Context, task, owner string, ttl time.Duration) (bool, error) {
+	f := bson.D{{"_id", task}, {"owner", owner}}
+	update := bson.M{"$set": bson.M{"expires_at": time.Now().Add(ttl)}}
+	r, err := s.collection().UpdateOne(ctx, f, update)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount == 1, nil
+}
+
+func (s *mongoLeaseStore) Release(ctx context.Context, task, owner string, status TaskStatus) error {
+	f := bson.D{{"_id", task}, {"owner", owner}}
+	update := bson.M{"$set": bson.M{"expires_at": time.Now(), "last_status": status}}
+	_, err := s.collection().UpdateOne(ctx, f, update)
+	return err
+}
+
+func (s *mongoLeaseStore) Leases(ctx context.Context) (map[string]TaskLease, error) {
+	cur, err := s.collection().Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var all []TaskLease
+	if err := cur.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	res := make(map[string]TaskLease, len(all))
+	for _, l := range all {
+		res[l.Task] = l
+	}
+	return res, nil
+}
+
+// memoryLeaseStore keeps the leases in memory. it only works for a single instance, e.g. for development and tests
+type memoryLeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]TaskLease
+	// now can be replaced to simulate expired leases
+	now func() time.Time
+}
+
+func newMemoryLeaseStore() *memoryLeaseStore {
+	return &memoryLeaseStore{leases: make(map[string]TaskLease), now: time.Now}
+}
+
+func (s *memoryLeaseStore) Acquire(ctx context.Context, task, owner string, slot time.Time, ttl time.Duration) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	l, ok := s.leases[task]
+	if ok && (!l.LastSlot.Before(slot) || l.Owner != owner && l.ExpiresAt.After(now)) {
+		return false, l.Owner, nil
+	}
+	l.Task, l.Owner, l.LastSlot, l.AcquiredAt, l.ExpiresAt = task, owner, slot, now, now.Add(ttl)
+	s.leases[task] = l
+	return true, owner, nil
+}
+
+func (s *memoryLeaseStore) Renew(ctx context.Context, task, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[task]
+	if !ok || l.Owner != owner {
+		return false, nil
+	}
+	l.ExpiresAt = s.now().Add(ttl)
+	s.leases[task] = l
+	return true, nil
+}
+
+func (s *memoryLeaseStore) Release(ctx context.Context, task, owner string, status TaskStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[task]
+	if !ok || l.Owner != owner {
+		return nil
+	}
+	l.ExpiresAt = s.now()
+	l.LastStatus = status
+	s.leases[task] = l
+	return nil
+}
+
+func (s *memoryLeaseStore) Leases(ctx context.Context) (map[string]TaskLease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]TaskLease, len(s.leases))
+	for k, l := range s.leases {
+		res[k] = l
+	}
+	return res, nil
+}
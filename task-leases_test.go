@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is the injected now of the memoryLeaseStore
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLeaseStore() (*memoryLeaseStore, *testClock) {
+	clock := &testClock{now: time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)}
+	store := newMemoryLeaseStore()
+	store.now = clock.Now
+	return store, clock
+}
+
+// TestCompetingSchedulers runs the same task on several schedulers sharing one lease store. every slot must
+// be run by exactly one of them
+func TestCompetingSchedulers(t *testing.T) {
+	const schedulers = 8
+	const slots = 20
+	store, clock := newTestLeaseStore()
+
+	var runs int32
+	run := func() error {
+		atomic.AddInt32(&runs, 1)
+		// keep the lease for a moment, so the other schedulers try to acquire it while the task is running
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	var all []*scheduledTask
+	for i := 0; i < schedulers; i++ {
+		s := &scheduler{leases: store, owner: fmt.Sprintf("instance-%d", i)}
+		if err := s.register("test", "@every 15m", run); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, s.find("test"))
+	}
+
+	slot := clock.Now()
+	for n := 0; n < slots; n++ {
+		slot = all[0].next(slot)
+		clock.Add(time.Minute * 15)
+		atomic.StoreInt32(&runs, 0)
+		var executed int32
+		var wg sync.WaitGroup
+		for _, task := range all {
+			wg.Add(1)
+			go func(task *scheduledTask) {
+				defer wg.Done()
+				if task.execute("schedule", slot) {
+					atomic.AddInt32(&executed, 1)
+				}
+			}(task)
+		}
+		wg.Wait()
+		if runs != 1 || executed != 1 {
+			t.Fatalf("slot %s has been run %d times by %d schedulers, expected exactly once", slot, runs, executed)
+		}
+	}
+
+	ls, _ := store.Leases(context.Background())
+	if l := ls["test"]; !l.LastSlot.Equal(slot) || l.LastStatus.LastResult != taskResultSuccess {
+		t.Fatalf("unexpected lease after the last slot: %+v", l)
+	}
+}
+
+// TestExpiredLeaseIsTakenOver simulates an instance which died while running a task
+func TestExpiredLeaseIsTakenOver(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestLeaseStore()
+	ttl := time.Minute * 2
+	first := clock.Now()
+
+	if ok, _, err := store.Acquire(ctx, "test", "crashed", first, ttl); err != nil || !ok {
+		t.Fatalf("could not acquire free lease: %v", err)
+	}
+	clock.Add(ttl + time.Second)
+	ok, owner, err := store.Acquire(ctx, "test", "survivor", first.Add(time.Minute*15), ttl)
+	if err != nil || !ok || owner != "survivor" {
+		t.Fatalf("expired lease has not been taken over: ok=%v owner=%s err=%v", ok, owner, err)
+	}
+	if ok, _ := store.Renew(ctx, "test", "crashed", ttl); ok {
+		t.Fatal("the previous owner renewed a lease it lost")
+	}
+	if err := store.Release(ctx, "test", "crashed", TaskStatus{LastResult: taskResultFailed}); err != nil {
+		t.Fatal(err)
+	}
+	if ls, _ := store.Leases(ctx); ls["test"].Owner != "survivor" || ls["test"].LastStatus.LastResult == taskResultFailed {
+		t.Fatalf("the previous owner released a lease it lost: %+v", ls["test"])
+	}
+}
+
+// TestLiveLeaseIsNotStolen makes sure a renewed lease stays with its owner even if the next slot is due
+func TestLiveLeaseIsNotStolen(t *testing.T) {
+	ctx := context.Background()
+	store, clock := newTestLeaseStore()
+	ttl := time.Minute * 2
+	first := clock.Now()
+
+	if ok, _, err := store.Acquire(ctx, "test", "owner", first, ttl); err != nil || !ok {
+		t.Fatalf("could not acquire free lease: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		clock.Add(ttl / 2)
+		if ok, err := store.Renew(ctx, "test", "owner", ttl); err != nil || !ok {
+			t.Fatalf("could not renew lease: %v", err)
+		}
+		ok, owner, err := store.Acquire(ctx, "test", "thief", first.Add(time.Minute*time.Duration(i+1)), ttl)
+		if err != nil || ok || owner != "owner" {
+			t.Fatalf("live lease has been stolen: ok=%v owner=%s err=%v", ok, owner, err)
+		}
+	}
+	// the same slot must not be run again once the lease has been released
+	if err := store.Release(ctx, "test", "owner", TaskStatus{}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := store.Acquire(ctx, "test", "thief", first, ttl); ok {
+		t.Fatal("a slot which has already been run has been acquired again")
+	}
+}
@@ -8,21 +8,52 @@ import (
 	"time"
 )
 
+// runTasks registers all background tasks at the scheduler and starts it. the schedules can be replaced in
+// tasks.schedules
 func runTasks() {
-	deleteOldBookings()
-	interval, err := time.ParseDuration(cfg.Service.TaskInterval)
-	if err != nil {
-		logrus.Warnf("could not parse duration %s. going to use default 15 minute interval time for tasks", cfg.Service.TaskInterval)
-		interval = time.Minute * 15
+	applyTaskInterval()
+	register := func(name, spec string, run func() error) {
+		if err := tasks.register(name, spec, run); err != nil {
+			logrus.Error(err)
+		}
 	}
-	for range time.Tick(interval) {
-		go deleteOldBookings()
+	// the old data is removed at night, when nobody books or invites guests
+	register("delete-old-bookings", "0 2 * * *", deleteOldBookings)
+	register("visitor-retention", "30 2 * * *", deleteOldVisitorData)
+	// the reminders are sent after an hour of the previous day chosen by the users, so they run every hour
+	register("host-visit-reminders", "0 * * * *", sendHostVisitReminders)
+	register("booking-reminders", "0 * * * *", sendBookingReminders)
+	// guests are reminded once a few days before the visit, a single run in the morning is enough
+	register("guest-invitation-reminders", "0 9 * * *", sendGuestInvitationReminders)
+	register("webhook-deliveries", "@every 1m", retryWebhookDeliveries)
+	tasks.start()
+}
+
+// applyTaskInterval keeps the deprecated service.task_interval working. it used to define how often the old
+// bookings were deleted, so it becomes the schedule of delete-old-bookings unless that one is configured
+func applyTaskInterval() {
+	interval := cfg.Service.TaskInterval
+	if interval == "" {
+		return
 	}
+	if _, ok := cfg.Tasks.Schedules["delete-old-bookings"]; ok {
+		logrus.Warn("service.task_interval is deprecated and ignored, because tasks.schedules defines delete-old-bookings")
+		return
+	}
+	if _, err := time.ParseDuration(interval); err != nil {
+		logrus.Warnf("service.task_interval is deprecated and %q is no valid duration. use tasks.schedules instead", interval)
+		return
+	}
+	if cfg.Tasks.Schedules == nil {
+		cfg.Tasks.Schedules = make(map[string]string)
+	}
+	cfg.Tasks.Schedules["delete-old-bookings"] = "@every " + interval
+	logrus.Warnf("service.task_interval is deprecated. use tasks.schedules.delete-old-bookings: \"@every %s\" instead", interval)
 }
 
-func deleteOldBookings() {
+func deleteOldBookings() error {
 	if !cfg.Bookings.AutoDelete {
-		return
+		return nil
 	}
 	ds := fmt.Sprintf("%dh", cfg.Bookings.DeleteAfterDays * 24)
 	age, err := time.ParseDuration(ds)
@@ -32,13 +63,26 @@ func deleteOldBookings() {
 	}
 	d := time.Now().Add(- age).Format("2006-01-02")
 	logrus.WithField("before_date", d).Info("executing delete old bookings task")
-	filter := bson.M{
-		"date": bson.M{"$lte": d},
+	filter := bson.D{{"date", bson.D{{"$lte", d}}}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	// the statistics have to be stored before the bookings are gone
+	if cfg.Bookings.Archive {
+		n, err := archiveBookings(ctx, filter)
+		if err != nil {
+			return err
+		}
+		logrus.WithField("archived_days", n).Info("archived old bookings")
 	}
-	dr, err := client.Database("office_checkin").Collection("bookings").DeleteMany(context.Background(), filter)
+	dr, err := client.Database("office_checkin").Collection("bookings").DeleteMany(ctx, filter)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return err
+	}
+	// past parking spaces are not needed anymore, neither of employees nor of guests
+	pr, err := client.Database("office_checkin").Collection("parking_bookings").DeleteMany(ctx, filter)
+	if err != nil {
+		return err
 	}
-	logrus.WithField("deleted_items", dr.DeletedCount).Info("executed delete old bookings task")
+	logrus.WithFields(logrus.Fields{"deleted_items": dr.DeletedCount, "deleted_parking_bookings": pr.DeletedCount}).Info("executed delete old bookings task")
+	return nil
 }
\ No newline at end of file
@@ -19,6 +19,11 @@ type User struct {
 	FirstName  string             `json:"first_name"`
 	LastName   string             `json:"last_name"`
 	Email      string             `json:"email"`
+	Locale     string             `json:"locale"`
+	// CalendarTokenHash is the sha256 hash of the token protecting the personal iCal feed of the user
+	CalendarTokenHash string `json:"-"`
+	// Notifications is nil until the user changes the preferences, the defaults apply until then
+	Notifications *NotificationPreferences `json:"notifications"`
 }
 
 func getUser(c *gin.Context) {
@@ -36,6 +41,10 @@ func getUser(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
+	if u.Notifications == nil {
+		p := defaultNotificationPreferences()
+		u.Notifications = &p
+	}
 	c.JSON(http.StatusOK, u)
 }
 
@@ -50,39 +59,43 @@ func updateUser(c *gin.Context) {
 		})
 		return
 	}
+	// the mail address is taken from the token, so users cannot claim the mail address of someone else
+	u.FirebaseID = uid
+	u.Email = c.GetString("userMail")
+	// only the preferences are validated, the profile itself is stored as sent like it always has been
 	errs := []string{}
-	if u.FirstName == "" {
-		errs = append(errs, "first name cannot be empty")
+	u.Locale = normalizeLocale(u.Locale)
+	if u.Locale != "" && !isSupportedLocale(u.Locale) {
+		errs = append(errs, "locale is not supported")
 	}
-	if u.LastName == "" {
-		errs = append(errs, "last name cannot be empty")
+	if u.Notifications != nil {
+		errs = append(errs, validateNotificationPreferences(u.Notifications)...)
 	}
-	if u.Email == "" {
-		errs = append(errs, "email cannot be empty")
-	}
-	u.FirebaseID = uid
-	u.Email = c.GetString("userMail")
-	if u.ID.IsZero() {
-		u.ID = primitive.NewObjectID()
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
 	}
-	f := bson.D{{"firebase_id", uid}}
+	f := bson.D{{"firebaseid", uid}}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	update := bson.M{
-		"$set": struct {
-			LastName   string `bson:"lastname"`
-			FirstName  string `bson:"firstname"`
-			Email      string `bson:"email"`
-			FirebaseID string `bson:"firebaseid"`
-		}{
-			LastName:   u.LastName,
-			FirstName:  u.FirstName,
-			Email:      u.Email,
-			FirebaseID: u.FirebaseID,
-		},
+	set := bson.M{
+		"lastname":   u.LastName,
+		"firstname":  u.FirstName,
+		"email":      u.Email,
+		"firebaseid": u.FirebaseID,
+	}
+	// clients unaware of the locale or the preferences do not send them, which must not reset them
+	if u.Locale != "" {
+		set["locale"] = u.Locale
+	}
+	if u.Notifications != nil {
+		set["notifications"] = u.Notifications
 	}
 	opts := options.Update().SetUpsert(true)
-	_, err := client.Database("office_checkin").Collection("users").UpdateMany(ctx, f, update, opts)
+	_, err := client.Database("office_checkin").Collection("users").UpdateMany(ctx, f, bson.M{"$set": set}, opts)
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// maxVisitDays limits how many days a single visit may span
+const maxVisitDays = 14
+
+// maxVisitGroupSize limits the number of guests invited with a single request
+const maxVisitGroupSize = 50
+
+// AddVisitRequest creates a visit for a single guest or, if Visitors is set, for a group of guests.
+// every guest of a group gets an own visit with an own invitation
+type AddVisitRequest struct {
+	Visit
+	Visitors []Visitor `json:"visitors"`
+}
+
+// VisitGroup is returned when a group of guests has been invited
+type VisitGroup struct {
+	ID      primitive.ObjectID `json:"id"`
+	Date    string             `json:"date"`
+	EndDate string             `json:"end_date"`
+	Visits  []Visit            `json:"visits"`
+}
+
+// lastDate returns the last day of the visit. visits created before multi-day visits only have a date
+func (v Visit) lastDate() string {
+	if v.EndDate == "" {
+		return v.Date
+	}
+	return v.EndDate
+}
+
+// dates returns every day of the visit
+func (v Visit) dates() []string {
+	return dateRange(v.Date, v.lastDate())
+}
+
+// dateRange returns all yyyy-mm-dd dates from start to end including both
+func dateRange(start, end string) []string {
+	s, err := time.Parse("2006-01-02", start)
+	if err != nil {
+		return nil
+	}
+	e, err := time.Parse("2006-01-02", end)
+	if err != nil {
+		return []string{start}
+	}
+	dates := []string{}
+	for d := s; !d.After(e); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d.Format("2006-01-02"))
+	}
+	return dates
+}
+
+// visitOnDateFilter matches all visits taking place on the date
+func visitOnDateFilter(date string) bson.D {
+	return visitOverlapFilter(date, date)
+}
+
+// visitOverlapFilter matches all visits with at least one day between from and to
+func visitOverlapFilter(from, to string) bson.D {
+	return bson.D{
+		{"date", bson.D{{"$lte", to}}},
+		{"$or", bson.A{
+			bson.D{{"enddate", bson.D{{"$gte", from}}}},
+			bson.D{{"enddate", bson.D{{"$exists", false}}}, {"date", bson.D{{"$gte", from}}}},
+		}},
+	}
+}
+
+// formatDateRange formats the days of the visit according to the locale
+func formatDateRange(locale string, v Visit) string {
+	if v.lastDate() == v.Date {
+		return formatDate(locale, v.Date)
+	}
+	return formatDate(locale, v.Date) + " – " + formatDate(locale, v.lastDate())
+}
+
+// visitsPerDay counts the visits of the site on every day between from and to. the visit with the id
+// exclude is not counted, so a visit can be moved without blocking itself. declined visits do not take
+// any capacity
+func visitsPerDay(ctx context.Context, site, from, to string, exclude primitive.ObjectID) (map[string]int, error) {
+	f := append(visitOverlapFilter(from, to),
+		bson.E{"site", site},
+		bson.E{"invitationstatus", bson.D{{"$ne", InvitationStatusDeclined}}},
+	)
+	if !exclude.IsZero() {
+		f = append(f, bson.E{"_id", bson.D{{"$ne", exclude}}})
+	}
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	n := make(map[string]int)
+	for cur.Next(ctx) {
+		var v Visit
+		if err := cur.Decode(&v); err != nil {
+			return nil, err
+		}
+		for _, d := range v.dates() {
+			if d >= from && d <= to {
+				n[d]++
+			}
+		}
+	}
+	return n, cur.Err()
+}
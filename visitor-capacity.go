@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultVisitorCapacity is used if neither the site nor the visitors config define a capacity
+const defaultVisitorCapacity = 400
+
+// maxAvailabilityDays limits the range of the availability endpoint
+const maxAvailabilityDays = 366
+
+// visitorCapacity returns the number of visits allowed at the site on the date. a capacity of 0 closes the
+// site for guests, only an unset capacity falls back to the default
+func visitorCapacity(site, date string) int {
+	capacity := defaultVisitorCapacity
+	if cfg.Visitors.Capacity != nil {
+		capacity = *cfg.Visitors.Capacity
+	}
+	sc, ok := cfg.Visitors.Sites[site]
+	if !ok {
+		return capacity
+	}
+	if c, ok := sc.Dates[date]; ok {
+		return c
+	}
+	if d, err := time.Parse("2006-01-02", date); err == nil {
+		if c, ok := sc.Weekdays[strings.ToLower(d.Weekday().String())]; ok {
+			return c
+		}
+	}
+	if sc.Capacity != nil {
+		return *sc.Capacity
+	}
+	return capacity
+}
+
+// initVisitorCapacity prepares the visitor_capacity collection, which counts the guests per site and day, so
+// the capacity can be reserved atomically. days without a counter are counted from the visits. it has to run
+// before requests are handled, otherwise a reservation could create a counter missing the existing visits
+func initVisitorCapacity() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	coll := client.Database("office_checkin").Collection("visitor_capacity")
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"site", 1}, {"date", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	today := time.Now().Format("2006-01-02")
+	// the counters of past days are not needed anymore
+	if _, err := coll.DeleteMany(ctx, bson.D{{"date", bson.D{{"$lt", today}}}}); err != nil {
+		logrus.Error(err)
+	}
+	sites, err := client.Database("office_checkin").Collection("visits").Distinct(ctx, "site", visitOverlapFilter(today, "9999-12-31"))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	created := 0
+	for _, s := range sites {
+		site, ok := s.(string)
+		if !ok {
+			continue
+		}
+		visits, err := visitsPerDay(ctx, site, today, "9999-12-31", primitive.NilObjectID)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for date, n := range visits {
+			_, err := coll.InsertOne(ctx, bson.M{"site": site, "date": date, "visits": n})
+			if err == nil {
+				created++
+			} else if !mongo.IsDuplicateKeyError(err) {
+				logrus.Error(err)
+				return
+			}
+		}
+	}
+	if created > 0 {
+		logrus.WithField("days", created).Info("counted the visits of days without a visitor capacity counter")
+	}
+}
+
+// reserveVisitorCapacity counts the guests against the capacity of the site on all dates. if a date has not
+// enough space left, nothing is reserved and the date and its capacity are returned
+func reserveVisitorCapacity(ctx context.Context, site string, dates []string, guests int) (bool, string, int, error) {
+	coll := client.Database("office_checkin").Collection("visitor_capacity")
+	for i, d := range dates {
+		capacity := visitorCapacity(site, d)
+		full := guests > capacity
+		// the counter of a day is created by the first reservation. if the filter does not match an
+		// existing counter, the upsert fails because of the unique index. this happens if the day is full
+		// or if another reservation has just created the counter, so it is tried once more
+		for attempt := 0; attempt < 2 && !full; attempt++ {
+			f := bson.D{{"site", site}, {"date", d}, {"visits", bson.D{{"$lte", capacity - guests}}}}
+			_, err := coll.UpdateOne(ctx, f, bson.M{"$inc": bson.M{"visits": guests}}, options.Update().SetUpsert(true))
+			if err == nil {
+				break
+			}
+			if !mongo.IsDuplicateKeyError(err) {
+				releaseVisitorCapacity(ctx, site, dates[:i], guests)
+				return false, d, capacity, err
+			}
+			full = attempt == 1
+		}
+		if full {
+			releaseVisitorCapacity(ctx, site, dates[:i], guests)
+			return false, d, capacity, nil
+		}
+	}
+	return true, "", 0, nil
+}
+
+// releaseVisitorCapacity gives the capacity reserved for the guests on the dates back
+func releaseVisitorCapacity(ctx context.Context, site string, dates []string, guests int) {
+	if len(dates) == 0 {
+		return
+	}
+	f := bson.D{{"site", site}, {"date", bson.D{{"$in", dates}}}}
+	_, err := client.Database("office_checkin").Collection("visitor_capacity").UpdateMany(ctx, f, bson.M{"$inc": bson.M{"visits": -guests}})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// releaseVisitCapacity gives the capacity of the visit back. declined visits do not hold any capacity
+func releaseVisitCapacity(ctx context.Context, v Visit) {
+	if v.InvitationStatus != InvitationStatusDeclined {
+		releaseVisitorCapacity(ctx, v.Site, v.dates(), 1)
+	}
+}
+
+// restoreVisitCapacity counts the visit again after its capacity has been released, e.g. if rescheduling it
+// failed. the visit held the capacity before, so it is not checked again
+func restoreVisitCapacity(ctx context.Context, v Visit) {
+	if v.InvitationStatus == InvitationStatusDeclined {
+		return
+	}
+	coll := client.Database("office_checkin").Collection("visitor_capacity")
+	for _, d := range v.dates() {
+		_, err := coll.UpdateOne(ctx, bson.D{{"site", v.Site}, {"date", d}}, bson.M{"$inc": bson.M{"visits": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// defaultVisitorSite returns the site of visits created without one. it is empty if neither the config
+// defines a default site nor all areas belong to the same location
+func defaultVisitorSite(ctx context.Context) (string, error) {
+	if cfg.Visitors.DefaultSite != "" {
+		return cfg.Visitors.DefaultSite, nil
+	}
+	locations, err := cachedAreas.locations(ctx)
+	if err != nil || len(locations) != 1 {
+		return "", err
+	}
+	return locations[0], nil
+}
+
+// migrateVisitSites sets the default site on visits created before visits had a site, so they are counted
+// against the capacity of the site
+func migrateVisitSites() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	f := bson.D{{"$or", bson.A{
+		bson.D{{"site", bson.D{{"$exists", false}}}},
+		bson.D{{"site", ""}},
+	}}}
+	n, err := client.Database("office_checkin").Collection("visits").CountDocuments(ctx, f)
+	if err != nil || n == 0 {
+		if err != nil {
+			logrus.Error(err)
+		}
+		return
+	}
+	site, err := defaultVisitorSite(ctx)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if site == "" {
+		logrus.WithField("visits", n).Warn("visits without a site are not counted against any capacity. set visitors.default_site to assign them to a site")
+		return
+	}
+	r, err := client.Database("office_checkin").Collection("visits").UpdateMany(ctx, f, bson.M{"$set": bson.M{"site": site}})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"visits": r.ModifiedCount, "site": site}).Info("assigned visits without a site to the default site")
+}
+
+// visitorCapacityError is returned to the host if the capacity of the date is exhausted
+func visitorCapacityError(date string, capacity int) ErrorResponse {
+	return ErrorResponse{
+		Code:   http.StatusConflict,
+		Errors: []string{fmt.Sprintf("the site allows %d visits on %s and there is not enough space left. you have to select another date", capacity, date)},
+	}
+}
+
+// VisitorAvailability is the visitor capacity of a site on a single date
+type VisitorAvailability struct {
+	Date      string `json:"date"`
+	Capacity  int    `json:"capacity"`
+	Visits    int    `json:"visits"`
+	Available int    `json:"available"`
+}
+
+// getVisitorAvailability lists the visitor capacity of the site for every day in the requested range.
+// from defaults to today and days to 30
+func getVisitorAvailability(c *gin.Context) {
+	site := c.Param("location")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ok, err := cachedAreas.hasLocation(ctx, site)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Code:   http.StatusNotFound,
+			Errors: []string{"the site could not be found"},
+		})
+		return
+	}
+
+	errs := []string{}
+	from := time.Now().Truncate(time.Hour * 24)
+	if q := c.Query("from"); q != "" {
+		if from, err = time.Parse("2006-01-02", q); err != nil {
+			errs = append(errs, "date malformed. must be yyyy-mm-dd")
+		}
+	}
+	days := 30
+	if q := c.Query("days"); q != "" {
+		if days, err = strconv.Atoi(q); err != nil || days < 1 || days > maxAvailabilityDays {
+			errs = append(errs, fmt.Sprintf("days must be a number between 1 and %d", maxAvailabilityDays))
+		}
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	to := from.AddDate(0, 0, days-1)
+
+	visits, err := visitsPerDay(ctx, site, from.Format("2006-01-02"), to.Format("2006-01-02"), primitive.NilObjectID)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+
+	res := make([]VisitorAvailability, 0, days)
+	unavailable := []string{}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		a := VisitorAvailability{Date: date, Capacity: visitorCapacity(site, date), Visits: visits[date]}
+		if a.Available = a.Capacity - a.Visits; a.Available <= 0 {
+			a.Available = 0
+			unavailable = append(unavailable, date)
+		}
+		res = append(res, a)
+	}
+	c.JSON(http.StatusOK, struct {
+		Site             string                `json:"site"`
+		Dates            []VisitorAvailability `json:"dates"`
+		UnavailableDates []string              `json:"unavailable_dates"`
+	}{
+		Site:             site,
+		Dates:            res,
+		UnavailableDates: unavailable,
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"time"
+)
+
+// defaultVisitorRetentionDays is used if no valid retention period is configured
+const defaultVisitorRetentionDays = 90
+
+// RetentionRun is the log entry of a single run of the visitor retention task. it only contains ids and
+// counts, so the log itself does not keep any personal data
+type RetentionRun struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	StartedAt  time.Time          `bson:"started_at" json:"started_at"`
+	FinishedAt time.Time          `bson:"finished_at" json:"finished_at"`
+	DryRun     bool               `bson:"dry_run" json:"dry_run"`
+	// Mode is delete or anonymize and describes what happened to the visits
+	Mode string `bson:"mode" json:"mode"`
+	// Cutoff is the first day whose visits are kept
+	Cutoff            string               `bson:"cutoff" json:"cutoff"`
+	Visits            []primitive.ObjectID `bson:"visits" json:"visits"`
+	Visitors          []primitive.ObjectID `bson:"visitors" json:"visitors"`
+	ParkingBookings   int64                `bson:"parking_bookings" json:"parking_bookings"`
+	Mails             int64                `bson:"mails" json:"mails"`
+	WebhookDeliveries int64                `bson:"webhook_deliveries" json:"webhook_deliveries"`
+	Error             string               `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// visitEndedBeforeFilter matches all visits whose last day is before the date
+func visitEndedBeforeFilter(date string) bson.D {
+	return bson.D{{"$or", bson.A{
+		bson.D{{"enddate", bson.D{{"$lt", date}}}},
+		bson.D{{"enddate", bson.D{{"$exists", false}}}, {"date", bson.D{{"$lt", date}}}},
+	}}}
+}
+
+// deleteOldVisitorData removes the personal data of guests whose visit ended more than
+// Visitors.DeleteAfterDays ago. visits are deleted or, with Visitors.Anonymize, stripped of all guest data
+// so they still count in statistics. directory entries are removed once no visit of the guest is left
+// in the retention period. with Visitors.DryRun nothing is changed, but the run is logged anyway
+func deleteOldVisitorData() error {
+	if !cfg.Visitors.AutoDelete {
+		return nil
+	}
+	days := cfg.Visitors.DeleteAfterDays
+	if days <= 0 {
+		logrus.Warnf("invalid retention period for visitors. going to use default of %d days", defaultVisitorRetentionDays)
+		days = defaultVisitorRetentionDays
+	}
+	now := time.Now()
+	cutoffTime := startOfDay(now).AddDate(0, 0, -days)
+	run := RetentionRun{
+		ID:        primitive.NewObjectID(),
+		StartedAt: now,
+		DryRun:    cfg.Visitors.DryRun,
+		Mode:      "delete",
+		Cutoff:    cutoffTime.Format("2006-01-02"),
+		Visits:    []primitive.ObjectID{},
+		Visitors:  []primitive.ObjectID{},
+	}
+	if cfg.Visitors.Anonymize {
+		run.Mode = "anonymize"
+	}
+	log := logrus.WithFields(logrus.Fields{"cutoff": run.Cutoff, "dry_run": run.DryRun, "mode": run.Mode})
+	log.Info("executing visitor retention task")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	err := applyVisitorRetention(ctx, &run, cutoffTime)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.FinishedAt = time.Now()
+	if _, err := client.Database("office_checkin").Collection("retention_runs").InsertOne(ctx, run); err != nil {
+		log.Error(err)
+	}
+	log.WithFields(logrus.Fields{
+		"visits":             len(run.Visits),
+		"visitors":           len(run.Visitors),
+		"parking_bookings":   run.ParkingBookings,
+		"mails":              run.Mails,
+		"webhook_deliveries": run.WebhookDeliveries,
+	}).Info("executed visitor retention task")
+	return err
+}
+
+// applyVisitorRetention collects everything older than the cutoff and removes it unless the run is a dry run
+func applyVisitorRetention(ctx context.Context, run *RetentionRun, cutoffTime time.Time) error {
+	db := client.Database("office_checkin")
+
+	vf := append(visitEndedBeforeFilter(run.Cutoff), bson.E{"anonymizedat", bson.D{{"$exists", false}}})
+	ids, err := distinctObjectIDs(ctx, db.Collection("visits"), "_id", vf)
+	if err != nil {
+		return err
+	}
+	run.Visits = ids
+
+	// guests with a visit in the retention period or in the future stay in the directory
+	kept, err := distinctObjectIDs(ctx, db.Collection("visits"), "visitor._id", visitOverlapFilter(run.Cutoff, "9999-12-31"))
+	if err != nil {
+		return err
+	}
+	// $not also matches entries migrated from old visits, which have no timestamps
+	df := bson.D{
+		{"_id", bson.D{{"$nin", kept}}},
+		{"created_at", bson.D{{"$not", bson.D{{"$gte", cutoffTime}}}}},
+		{"updated_at", bson.D{{"$not", bson.D{{"$gte", cutoffTime}}}}},
+	}
+	if run.Visitors, err = distinctObjectIDs(ctx, db.Collection("visitors"), "_id", df); err != nil {
+		return err
+	}
+
+	pf := bson.D{{"visit", bson.D{{"$exists", true}}}, {"date", bson.D{{"$lt", run.Cutoff}}}}
+	mf := bson.D{{"status", bson.D{{"$in", bson.A{mailStatusSent, mailStatusFailed}}}}, {"created_at", bson.D{{"$lt", cutoffTime}}}}
+	wf := bson.D{{"status", bson.D{{"$in", bson.A{webhookStatusOK, webhookStatusFailed}}}}, {"created_at", bson.D{{"$lt", cutoffTime}}}}
+
+	if run.DryRun {
+		if run.ParkingBookings, err = db.Collection("parking_bookings").CountDocuments(ctx, pf); err != nil {
+			return err
+		}
+		if run.Mails, err = db.Collection("mail_outbox").CountDocuments(ctx, mf); err != nil {
+			return err
+		}
+		run.WebhookDeliveries, err = db.Collection("webhook_deliveries").CountDocuments(ctx, wf)
+		return err
+	}
+
+	if len(run.Visits) > 0 {
+		f := bson.D{{"_id", bson.D{{"$in", run.Visits}}}}
+		if cfg.Visitors.Anonymize {
+			update := bson.M{
+				"$set": bson.M{
+					"visitor":        Visitor{},
+					"additionalinfo": "",
+					"anonymizedat":   time.Now(),
+				},
+				"$unset": bson.M{"registration": "", "invitationhistory": "", "invitationtoken": ""},
+			}
+			_, err = db.Collection("visits").UpdateMany(ctx, f, update)
+		} else {
+			_, err = db.Collection("visits").DeleteMany(ctx, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(run.Visitors) > 0 {
+		if _, err := db.Collection("visitors").DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", run.Visitors}}}}); err != nil {
+			return err
+		}
+	}
+	r, err := db.Collection("parking_bookings").DeleteMany(ctx, pf)
+	if err != nil {
+		return err
+	}
+	run.ParkingBookings = r.DeletedCount
+	if r, err = db.Collection("mail_outbox").DeleteMany(ctx, mf); err != nil {
+		return err
+	}
+	run.Mails = r.DeletedCount
+	if r, err = db.Collection("webhook_deliveries").DeleteMany(ctx, wf); err != nil {
+		return err
+	}
+	run.WebhookDeliveries = r.DeletedCount
+	return nil
+}
+
+// distinctObjectIDs returns the distinct object ids of the field in all documents matching the filter
+func distinctObjectIDs(ctx context.Context, coll *mongo.Collection, field string, filter bson.D) ([]primitive.ObjectID, error) {
+	values, err := coll.Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(primitive.ObjectID); ok && !id.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// getRetentionRuns returns the log of the last runs of the visitor retention task
+func getRetentionRuns(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{"started_at", -1}}).SetLimit(50)
+	cur, err := client.Database("office_checkin").Collection("retention_runs").Find(ctx, bson.D{}, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	runs := []RetentionRun{}
+	if err := cur.All(ctx, &runs); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, runs)
+}
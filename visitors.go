@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -19,6 +24,11 @@ type Visitor struct {
 	Phone     string             `bson:"phone" ,json:"Phone"`
 	Company   string             `bson:"company" ,json:"Company"`
 	CreatedBy string             `bson:"created_by" ,json:"CreatedBy"`
+	Locale    string             `bson:"locale" json:"Locale"`
+	CreatedAt time.Time          `bson:"created_at" json:"CreatedAt"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"UpdatedAt"`
+	// ReminderOptOut stops the reminders for unanswered invitations
+	ReminderOptOut bool `bson:"reminder_opt_out" json:"ReminderOptOut"`
 }
 
 type Supervisor struct {
@@ -32,11 +42,67 @@ type Visit struct {
 	ID                primitive.ObjectID `bson:"_id"`
 	Visitor           Visitor            `json:"visitor"`
 	Date              string             `json:"date"`
+	// EndDate is the last day of a visit spanning several days. it equals Date for single day visits
+	EndDate           string             `json:"end_date"`
+	// GroupID links the visits of guests invited together
+	GroupID           *primitive.ObjectID `json:"group_id,omitempty"`
+	// Site is the location of the areas the guest visits
+	Site              string             `json:"site"`
 	AdditionalInfo    string             `json:"additional_info"`
 	NeedsParkingSpace bool               `json:"needs_parking_space"`
 	User              string             `json:"user"`
 	Supervisor        Supervisor         `json:"supervisor"`
 	HasAccepted		  bool               `json:"has_accepted"`
+	// InvitationToken is the sha256 hash of the token sent to the guest. the token itself is never stored
+	InvitationToken     string                   `json:"-"`
+	InvitationExpiresAt time.Time                `json:"-"`
+	InvitationStatus    string                   `json:"invitation_status"`
+	InvitationHistory   []InvitationStatusChange `json:"invitation_history"`
+	HostReminderSent    bool                     `json:"-"`
+	GuestReminderSent   bool                     `json:"-"`
+	// ReminderOptOutToken is the sha256 hash of the token of the opt-out link in the invitation reminder
+	ReminderOptOutToken string `json:"-"`
+	// CheckedInAt and CheckedOutAt are set by the reception when the guest enters and leaves the building
+	CheckedInAt  *time.Time `json:"checked_in_at"`
+	CheckedOutAt *time.Time `json:"checked_out_at"`
+	CheckedInBy  string     `json:"checked_in_by,omitempty"`
+	// Parking is the parking space reserved for the guest if NeedsParkingSpace is set
+	Parking *ParkingAssignment `json:"parking,omitempty"`
+	// Registration is set once the guest completed the pre-registration form
+	Registration *VisitorRegistration `json:"registration,omitempty"`
+	// AnonymizedAt is set once the retention task removed the personal data of the guest
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+}
+
+// validateVisitor normalizes the contact data of the visitor and returns all validation errors
+func validateVisitor(v *Visitor) []string {
+	v.FirstName = strings.TrimSpace(v.FirstName)
+	v.LastName = strings.TrimSpace(v.LastName)
+	v.Company = strings.TrimSpace(v.Company)
+	v.Phone = strings.TrimSpace(v.Phone)
+	v.Email = strings.ToLower(strings.TrimSpace(v.Email))
+	v.Locale = normalizeLocale(v.Locale)
+	errs := []string{}
+	if v.FirstName == "" {
+		errs = append(errs, "first name cannot be empty")
+	}
+	if v.LastName == "" {
+		errs = append(errs, "last name cannot be empty")
+	}
+	if a, err := mail.ParseAddress(v.Email); err != nil || a.Address != v.Email {
+		errs = append(errs, "email is not a valid mail address")
+	}
+	if v.Locale != "" && !isSupportedLocale(v.Locale) {
+		errs = append(errs, "locale is not supported")
+	}
+	return errs
+}
+
+// findVisitorByMail returns the visitor of the directory with the given mail address
+func findVisitorByMail(ctx context.Context, email string) (v Visitor, err error) {
+	f := bson.D{{"email", strings.ToLower(strings.TrimSpace(email))}}
+	err = client.Database("office_checkin").Collection("visitors").FindOne(ctx, f).Decode(&v)
+	return
 }
 
 func addVisitor(c *gin.Context) {
@@ -52,16 +118,120 @@ func addVisitor(c *gin.Context) {
 		})
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	if errs := validateVisitor(&v); len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
+	// every mail address is only stored once, so returning guests are found again
+	existing, err := findVisitorByMail(ctx, v.Email)
+	if err == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"a visitor with this mail address already exists", "id: " + existing.ID.Hex()},
+		})
+		return
+	} else if err != mongo.ErrNoDocuments {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+
+	v.ID = primitive.NewObjectID()
+	v.CreatedBy = c.GetString("userId")
+	v.CreatedAt = time.Now()
+	v.UpdatedAt = v.CreatedAt
 	_, err = client.Database("office_checkin").Collection("visitors").InsertOne(ctx, v)
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusCreated, v)
+}
+
+// updateVisitor changes the contact data of a visitor. upcoming visits of the visitor are updated as well,
+// so the guest receives the mails at the new address. visits in the past are left untouched
+func updateVisitor(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		logrus.Info(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"cannot parse id"},
+		})
+		return
+	}
+	var v Visitor
+	if err := c.BindJSON(&v); err != nil {
+		logrus.Debug(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		})
+		return
+	}
+	if errs := validateVisitor(&v); len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if existing, err := findVisitorByMail(ctx, v.Email); err == nil && existing.ID != oid {
+		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+			Code:   http.StatusConflict,
+			Errors: []string{"a visitor with this mail address already exists", "id: " + existing.ID.Hex()},
+		})
+		return
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+
+	f := bson.D{{"_id", oid}}
+	if !c.GetBool("isAdmin") {
+		f = append(f, bson.E{"created_by", c.GetString("userId")})
+	}
+	update := bson.M{"$set": bson.M{
+		"first_name": v.FirstName,
+		"last_name":  v.LastName,
+		"email":      v.Email,
+		"phone":      v.Phone,
+		"company":    v.Company,
+		"locale":     v.Locale,
+		"updated_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = client.Database("office_checkin").Collection("visitors").FindOneAndUpdate(ctx, f, update, opts).Decode(&v)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the visitor could not be found"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+
+	vf := append(visitOverlapFilter(time.Now().Format("2006-01-02"), "9999-12-31"), bson.E{"visitor._id", oid})
+	_, err = client.Database("office_checkin").Collection("visits").UpdateMany(ctx, vf, bson.M{"$set": bson.M{"visitor": v}})
+	if err != nil {
+		logrus.Error(err)
+	}
+	c.JSON(http.StatusOK, v)
 }
 
 func getVisitor(c *gin.Context) {
@@ -94,31 +264,67 @@ func getVisitor(c *gin.Context) {
 	c.JSON(http.StatusOK, v)
 }
 
+// visitorSortFields maps the sort query parameter of the visitor list endpoint to the document fields
+var visitorSortFields = map[string]string{
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"company":    "company",
+	"email":      "email",
+}
+
+// getVisitors searches the visitor directory. q matches the name, company and mail address of the visitors
 func getVisitors(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	f := bson.D{}
-	rows, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
-	if err != nil {
-		logrus.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+	lo, errs := parseListOptions(c, visitorSortFields, "last_name")
+	if abortWithListErrors(c, errs) {
 		return
 	}
-	v := make(map[string]Visitor)
-	tv := Visit{}
-	for rows.Next(ctx) {
-		err := rows.Decode(&tv)
+	f := bson.D{}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		f = append(f, bson.E{"$or", bson.A{
+			bson.D{{"first_name", re}},
+			bson.D{{"last_name", re}},
+			bson.D{{"company", re}},
+			bson.D{{"email", re}},
+		}})
+	}
+	if c.Query("created-by") == "me" {
+		f = append(f, bson.E{"created_by", c.GetString("userId")})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var total int64
+	if lo.Envelope {
+		var err error
+		total, err = client.Database("office_checkin").Collection("visitors").CountDocuments(ctx, f)
 		if err != nil {
 			logrus.Error(err)
 			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 			return
 		}
-		if _, ok := v[tv.Visitor.Email]; !ok {
-			v[tv.Visitor.Email] = tv.Visitor
-		}
 	}
-
-	c.JSON(200, v)
+	cur, err := client.Database("office_checkin").Collection("visitors").Find(ctx, f, lo.findOptions())
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	visitors := []Visitor{}
+	if err := cur.All(ctx, &visitors); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if lo.Envelope {
+		c.JSON(http.StatusOK, Page{Items: visitors, NextCursor: lo.nextCursor(len(visitors), total), Total: total})
+		return
+	}
+	// the old response is keyed by the mail address of the visitors
+	v := make(map[string]Visitor, len(visitors))
+	for _, visitor := range visitors {
+		v[visitor.Email] = visitor
+	}
+	c.JSON(http.StatusOK, v)
 }
 
 func deleteVisit(c *gin.Context) {
@@ -140,33 +346,103 @@ func deleteVisit(c *gin.Context) {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	dr, err := client.Database("office_checkin").Collection("visits").DeleteOne(ctx, f)
-	if err != nil {
+	var v Visit
+	err = client.Database("office_checkin").Collection("visits").FindOneAndDelete(ctx, f).Decode(&v)
+	if err != nil && err != mongo.ErrNoDocuments {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
+	var deleted int64
+	if err == nil {
+		deleted = 1
+		releaseVisitCapacity(ctx, v)
+		releaseParking(ctx, v.Parking)
+		// only tell the guest about the cancellation if the visit has not already happened
+		if v.lastDate() >= time.Now().Format("2006-01-02") {
+			if err := sendCancellationMail(v); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
 	c.JSON(http.StatusOK, struct {
 		DeletedItems int64 `json:"deleted_items"`
 	}{
-		DeletedItems: dr.DeletedCount,
+		DeletedItems: deleted,
 	})
 }
 
+// deleteVisitor removes the visitor from the directory. visits keep their own copy of the contact data
 func deleteVisitor(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, ErrorNotImplemented)
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		logrus.Info(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"cannot parse id"},
+		})
+		return
+	}
+	f := bson.D{{"_id", oid}}
+	if !c.GetBool("isAdmin") {
+		f = append(f, bson.E{"created_by", c.GetString("userId")})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	r, err := client.Database("office_checkin").Collection("visitors").DeleteOne(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		DeletedItems int64 `json:"deleted_items"`
+	}{
+		DeletedItems: r.DeletedCount,
+	})
 }
 
+// resolveVisitor returns the directory entry for the visitor of a new visit. if the id is set, the stored
+// visitor is used. otherwise the visitor is looked up by the mail address and added to the directory if unknown
+func resolveVisitor(ctx context.Context, v Visitor, uid string) (Visitor, []string, error) {
+	if !v.ID.IsZero() {
+		var stored Visitor
+		err := client.Database("office_checkin").Collection("visitors").FindOne(ctx, bson.D{{"_id", v.ID}}).Decode(&stored)
+		if err == mongo.ErrNoDocuments {
+			return v, []string{"the visitor could not be found"}, nil
+		}
+		return stored, nil, err
+	}
+	if errs := validateVisitor(&v); len(errs) > 0 {
+		return v, errs, nil
+	}
+	stored, err := findVisitorByMail(ctx, v.Email)
+	if err == nil {
+		return stored, nil, nil
+	} else if err != mongo.ErrNoDocuments {
+		return v, nil, err
+	}
+	v.ID = primitive.NewObjectID()
+	v.CreatedBy = uid
+	v.CreatedAt = time.Now()
+	v.UpdatedAt = v.CreatedAt
+	_, err = client.Database("office_checkin").Collection("visitors").InsertOne(ctx, v)
+	return v, nil, err
+}
+
+// addVisit invites one guest or a group of guests. a visit may span several days, the capacity of the site
+// is checked for every day. every guest gets an own visit and invitation mail
 func addVisit(c *gin.Context) {
-	r := Visit{}
-	if err := c.BindJSON(&r); err != nil {
+	req := AddVisitRequest{}
+	if err := c.BindJSON(&req); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
 			Code:   http.StatusBadRequest,
 			Errors: []string{"body malformed"},
 		})
 		return
 	}
-	_, err := time.Parse("2006-01-02", r.Date)
+	r := req.Visit
+	start, err := time.Parse("2006-01-02", r.Date)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
 			Code:   http.StatusBadRequest,
@@ -174,10 +450,51 @@ func addVisit(c *gin.Context) {
 		})
 		return
 	}
-	if !isDateBookableForVisitor(r.Date) {
-		c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
-			Code:   http.StatusConflict,
-			Errors: []string{"there are more than 4 bookings for a visitor on this date. you have to select another date"},
+	if r.EndDate == "" {
+		r.EndDate = r.Date
+	}
+	end, err := time.Parse("2006-01-02", r.EndDate)
+	if err != nil || end.Before(start) || end.Sub(start) >= time.Hour*24*maxVisitDays {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{fmt.Sprintf("end date must be a yyyy-mm-dd date within %d days after the date", maxVisitDays)},
+		})
+		return
+	}
+	visitors := req.Visitors
+	if len(visitors) == 0 {
+		visitors = []Visitor{r.Visitor}
+	}
+	if len(visitors) > maxVisitGroupSize {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{fmt.Sprintf("you can invite at most %d visitors at once", maxVisitGroupSize)},
+		})
+		return
+	}
+	// clients created before visits had a site do not send one
+	if r.Site == "" {
+		if r.Site, err = defaultVisitorSite(c.Request.Context()); err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+	}
+	if r.Site == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"site cannot be empty"},
+		})
+		return
+	}
+	if ok, err := cachedAreas.hasLocation(c.Request.Context(), r.Site); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	} else if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"the site could not be found"},
 		})
 		return
 	}
@@ -196,34 +513,330 @@ func addVisit(c *gin.Context) {
 
 	r.User = c.GetString("userId")
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	ok, date, capacity, err := reserveVisitorCapacity(ctx, r.Site, r.dates(), len(visitors))
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusConflict, visitorCapacityError(date, capacity))
+		return
+	}
+	var group *primitive.ObjectID
+	if len(req.Visitors) > 0 {
+		id := primitive.NewObjectID()
+		group = &id
+	}
+	visits := make([]Visit, 0, len(visitors))
+	tokens := make([]string, 0, len(visitors))
+	docs := make([]interface{}, 0, len(visitors))
+	// releaseAll frees the capacity and the parking spaces reserved so far if the visits cannot be created
+	releaseAll := func() {
+		releaseVisitorCapacity(ctx, r.Site, r.dates(), len(visitors))
+		for _, v := range visits {
+			releaseParking(ctx, v.Parking)
+		}
+	}
+	seen := make(map[primitive.ObjectID]bool, len(visitors))
+	for i, rv := range visitors {
+		visitor, errs, err := resolveVisitor(ctx, rv, r.User)
+		if err != nil {
+			logrus.Error(err)
+			releaseAll()
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+		if len(errs) == 0 && seen[visitor.ID] {
+			errs = []string{"every visitor can only be invited once"}
+		}
+		if len(errs) > 0 {
+			if len(visitors) > 1 {
+				for j := range errs {
+					errs[j] = fmt.Sprintf("visitor %d: %s", i+1, errs[j])
+				}
+			}
+			releaseAll()
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+				Code:   http.StatusBadRequest,
+				Errors: errs,
+			})
+			return
+		}
+		seen[visitor.ID] = true
+		v := r
+		v.Visitor = visitor
+		v.GroupID = group
+		v.ID = primitive.NewObjectID()
+		v.HasAccepted = false
+		v.InvitationStatus = InvitationStatusPending
+		v.InvitationHistory = []InvitationStatusChange{}
+		v.CheckedInAt, v.CheckedOutAt, v.CheckedInBy = nil, nil, ""
+		token, err := newInvitationToken(&v)
+		if err != nil {
+			logrus.Error(err)
+			releaseAll()
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+		v.Parking = nil
+		if v.NeedsParkingSpace {
+			if err := assignVisitorParking(ctx, &v); err != nil {
+				releaseAll()
+				if err == errNoParkingSpace {
+					c.AbortWithStatusJSON(http.StatusConflict, parkingConflictError)
+					return
+				}
+				logrus.Error(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+				return
+			}
+		}
+		visits = append(visits, v)
+		tokens = append(tokens, token)
+		docs = append(docs, v)
+	}
+	_, err = client.Database("office_checkin").Collection("visits").InsertMany(ctx, docs)
+	if err != nil {
+		logrus.Error(err)
+		releaseAll()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	for i, v := range visits {
+		events.publish(Event{Type: EventVisitCreated, Date: v.Date, Data: v})
+		if err := sendInvitationMail(v, tokens[i]); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if group == nil {
+		c.JSON(http.StatusOK, visits[0])
+		return
+	}
+	c.JSON(http.StatusOK, VisitGroup{ID: *group, Date: r.Date, EndDate: r.EndDate, Visits: visits})
+}
+
+// VisitUpdate contains the fields of a visit the host may change. fields which are not sent stay untouched
+type VisitUpdate struct {
+	Date              *string `json:"date"`
+	EndDate           *string `json:"end_date"`
+	AdditionalInfo    *string `json:"additional_info"`
+	NeedsParkingSpace *bool   `json:"needs_parking_space"`
+}
+
+// updateVisit changes a visit of the host. if the date changes, the guest has to accept the invitation again
+// and receives a mail with the new date and a new invitation link
+func updateVisit(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		logrus.Info(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"visit id malformed"},
+		})
+		return
+	}
+	var r VisitUpdate
+	if err := c.BindJSON(&r); err != nil {
+		logrus.Info(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		})
+		return
+	}
+	f := bson.D{{"_id", oid}}
+	if !c.GetBool("isAdmin") {
+		f = append(f, bson.E{"user", c.GetString("userId")})
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	r.ID = primitive.NewObjectID()
-	r.Visitor.ID = primitive.NewObjectID()
-	r.HasAccepted = false
-	_, err = client.Database("office_checkin").Collection("visits").InsertOne(ctx, r)
+	var v Visit
+	err = client.Database("office_checkin").Collection("visits").FindOne(ctx, f).Decode(&v)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the visit could not be found"},
+			})
+			return
+		}
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
 		return
 	}
 
-	go func() {
-		date, _ := time.Parse("2006-01-02", r.Date)
-		if err = sendMail(r.Visitor.Email, r.ID.Hex(), r.Visitor.FirstName+" "+r.Visitor.LastName, date.Format("02.01.2006")); err != nil {
+	set := bson.M{}
+	if r.AdditionalInfo != nil {
+		v.AdditionalInfo = *r.AdditionalInfo
+		set["additionalinfo"] = v.AdditionalInfo
+	}
+	oldParking := v.Parking
+	if r.NeedsParkingSpace != nil {
+		v.NeedsParkingSpace = *r.NeedsParkingSpace
+		set["needsparkingspace"] = v.NeedsParkingSpace
+	}
+	// if only the date is sent, the visit keeps its length
+	start, end := v.Date, v.lastDate()
+	if r.Date != nil {
+		start = *r.Date
+		if r.EndDate == nil {
+			end = start
+			if s, err := time.Parse("2006-01-02", start); err == nil {
+				end = s.AddDate(0, 0, len(v.dates())-1).Format("2006-01-02")
+			}
+		}
+	}
+	if r.EndDate != nil {
+		end = *r.EndDate
+	}
+	rescheduled := start != v.Date || end != v.lastDate()
+	var token string
+	// undoReschedule moves the capacity back to the old days if the visit cannot be updated
+	undoReschedule := func() {}
+	if rescheduled {
+		d, err := time.Parse("2006-01-02", start)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+				Code:   http.StatusBadRequest,
+				Errors: []string{"date malformed. must be yyyy-mm-dd"},
+			})
+			return
+		}
+		if e, err := time.Parse("2006-01-02", end); err != nil || e.Before(d) || e.Sub(d) >= time.Hour*24*maxVisitDays {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+				Code:   http.StatusBadRequest,
+				Errors: []string{fmt.Sprintf("end date must be a yyyy-mm-dd date within %d days after the date", maxVisitDays)},
+			})
+			return
+		}
+		if d.Before(time.Now().Truncate(time.Hour * 24)) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+				Code:   http.StatusBadRequest,
+				Errors: []string{"the date must not be in the past"},
+			})
+			return
+		}
+		if v.CheckedInAt != nil {
+			c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{
+				Code:   http.StatusConflict,
+				Errors: []string{"the visitor has already been checked in"},
+			})
+			return
+		}
+		// the visit must not block itself, so its old days are given back before the new ones are reserved
+		old := v
+		releaseVisitCapacity(ctx, old)
+		ok, date, capacity, err := reserveVisitorCapacity(ctx, v.Site, dateRange(start, end), 1)
+		if err != nil || !ok {
+			restoreVisitCapacity(ctx, old)
+			if err != nil {
+				logrus.Error(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusConflict, visitorCapacityError(date, capacity))
+			return
+		}
+		undoReschedule = func() {
+			releaseVisitorCapacity(ctx, old.Site, dateRange(start, end), 1)
+			restoreVisitCapacity(ctx, old)
+		}
+		v.Date = start
+		v.EndDate = end
+		// the old link must not confirm the new date, so the guest gets a new token
+		if token, err = newInvitationToken(&v); err != nil {
 			logrus.Error(err)
+			undoReschedule()
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+		v.HasAccepted = false
+		v.InvitationStatus = InvitationStatusPending
+		v.HostReminderSent = false
+		set["date"] = v.Date
+		set["enddate"] = v.EndDate
+		set["hasaccepted"] = v.HasAccepted
+		set["invitationstatus"] = v.InvitationStatus
+		set["invitationtoken"] = v.InvitationToken
+		set["invitationexpiresat"] = v.InvitationExpiresAt
+		set["hostremindersent"] = v.HostReminderSent
+	}
+	// the parking space is booked for the days of the visit, so a new one is needed if the dates change.
+	// the old space is only released once the visit has been updated
+	if !v.NeedsParkingSpace {
+		v.Parking = nil
+	} else if v.Parking == nil || rescheduled {
+		if err := assignVisitorParking(ctx, &v); err != nil {
+			undoReschedule()
+			if err == errNoParkingSpace {
+				c.AbortWithStatusJSON(http.StatusConflict, parkingConflictError)
+				return
+			}
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
 		}
-	}()
-	c.JSON(http.StatusOK, r)
+	}
+	if v.Parking != oldParking {
+		set["parking"] = v.Parking
+	}
+	if len(set) == 0 {
+		c.JSON(http.StatusOK, v)
+		return
+	}
+	if _, err := client.Database("office_checkin").Collection("visits").UpdateOne(ctx, bson.D{{"_id", oid}}, bson.M{"$set": set}); err != nil {
+		logrus.Error(err)
+		undoReschedule()
+		if v.Parking != oldParking {
+			releaseParking(ctx, v.Parking)
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	if v.Parking != oldParking {
+		releaseParking(ctx, oldParking)
+	}
+	events.publish(Event{Type: EventVisitUpdated, Date: v.Date, Data: v})
+	if rescheduled {
+		if err := sendVisitUpdateMail(v, token); err != nil {
+			logrus.Error(err)
+		}
+	}
+	c.JSON(http.StatusOK, v)
+}
 
+// visitSortFields maps the sort query parameter of the visit list endpoint to the document fields
+var visitSortFields = map[string]string{
+	"date":         "date",
+	"last_name":    "visitor.last_name",
+	"company":      "visitor.company",
+	"has_accepted": "hasaccepted",
 }
 
 func getVisits(c *gin.Context) {
 	uid := c.GetString("userId")
-	f := bson.D{{"user", uid}}
+	lo, errs := parseListOptions(c, visitSortFields, "date")
+	f, ferrs := parseListFilter(c, false, "", true)
+	if abortWithListErrors(c, append(errs, ferrs...)) {
+		return
+	}
+	f = append(f, bson.E{"user", uid})
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f)
+	var total int64
+	if lo.Envelope {
+		var err error
+		total, err = client.Database("office_checkin").Collection("visits").CountDocuments(ctx, f)
+		if err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+	}
+	cur, err := client.Database("office_checkin").Collection("visits").Find(ctx, f, lo.findOptions())
 	if err != nil {
 		logrus.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
@@ -239,38 +852,29 @@ func getVisits(c *gin.Context) {
 		}
 		visits = append(visits, v)
 	}
+	if lo.Envelope {
+		c.JSON(http.StatusOK, Page{Items: visits, NextCursor: lo.nextCursor(len(visits), total), Total: total})
+		return
+	}
 	c.JSON(http.StatusOK, visits)
 }
 
+// getSingleVisit shows the visit to the guest. the id parameter is the invitation token from the mail
 func getSingleVisit(c *gin.Context) {
-	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
-	if err != nil {
-		logrus.Info(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
-			Code:   http.StatusBadRequest,
-			Errors: []string{"visit id malformed"},
-		})
-		return
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	f := bson.D{{"_id", oid}}
-
-	visit := Visit{}
-
-	err = client.Database("office_checkin").Collection("visits").FindOne(ctx, f).Decode(&visit)
+	visit, err := findVisitByInvitationToken(ctx, c.Param("id"))
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, ErrorResponse{
+			c.JSON(http.StatusNotFound, localizeErrors(c, ErrorResponse{
 				Code:   http.StatusNotFound,
-				Errors: []string{"the visit could not be found"},
-			})
+				Errors: []string{"the invitation is invalid or expired"},
+			}))
 			return
 		}
 		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, ErrorInternalError)
+		c.JSON(http.StatusInternalServerError, localizeErrors(c, ErrorInternalError))
 		return
 	}
 
@@ -280,4 +884,65 @@ func getSingleVisit(c *gin.Context) {
 	visit.NeedsParkingSpace = false
 	visit.User = ""
 	c.JSON(http.StatusOK, visit)
-}
\ No newline at end of file
+}
+
+// migrateVisitorDirectory adds the guests of visits created before the visitor directory existed to the
+// directory and links their visits to the new entries. guests already in the directory are skipped
+func migrateVisitorDirectory() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	pipeline := mongo.Pipeline{
+		{{"$sort", bson.D{{"date", -1}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"$toLower", "$visitor.email"}}},
+			{"visitor", bson.D{{"$first", "$visitor"}}},
+			{"user", bson.D{{"$first", "$user"}}},
+		}}},
+	}
+	cur, err := client.Database("office_checkin").Collection("visits").Aggregate(ctx, pipeline)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	var groups []struct {
+		Email   string  `bson:"_id"`
+		Visitor Visitor `bson:"visitor"`
+		User    string  `bson:"user"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		logrus.Error(err)
+		return
+	}
+	added := 0
+	for _, g := range groups {
+		if g.Email == "" {
+			continue
+		}
+		if _, err := findVisitorByMail(ctx, g.Email); err != mongo.ErrNoDocuments {
+			if err != nil {
+				logrus.Error(err)
+			}
+			continue
+		}
+		v := g.Visitor
+		v.ID = primitive.NewObjectID()
+		v.Email = g.Email
+		if v.CreatedBy == "" {
+			v.CreatedBy = g.User
+		}
+		v.CreatedAt = time.Now()
+		v.UpdatedAt = v.CreatedAt
+		if _, err := client.Database("office_checkin").Collection("visitors").InsertOne(ctx, v); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		f := bson.D{{"visitor.email", primitive.Regex{Pattern: "^" + regexp.QuoteMeta(g.Email) + "$", Options: "i"}}}
+		if _, err := client.Database("office_checkin").Collection("visits").UpdateMany(ctx, f, bson.M{"$set": bson.M{"visitor._id": v.ID}}); err != nil {
+			logrus.Error(err)
+		}
+		added++
+	}
+	if added > 0 {
+		logrus.WithField("visitors", added).Info("added the guests of existing visits to the visitor directory")
+	}
+}
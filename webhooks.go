@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	webhookMaxAttempts   = 5
+	webhookRetryDelay    = time.Minute
+	webhookTimeout       = time.Second * 10
+	webhookStatusQueued  = "pending"
+	webhookStatusSending = "sending"
+	webhookStatusOK      = "delivered"
+	webhookStatusFailed  = "failed"
+	// deliveries which are in sending state for longer than this are considered lost, e.g. because the
+	// service has been restarted while sending them
+	webhookSendingTimeout = time.Minute * 5
+)
+
+// Webhook is a subscription of an external system for one or more events
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"secret,omitempty"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedBy string             `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WebhookDelivery logs a single event sent to a webhook including all delivery attempts
+type WebhookDelivery struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	WebhookID    primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	Event        string             `bson:"event" json:"event"`
+	Payload      string             `bson:"payload" json:"payload"`
+	Status       string             `bson:"status" json:"status"`
+	Attempts     int                `bson:"attempts" json:"attempts"`
+	ResponseCode int                `bson:"response_code" json:"response_code"`
+	LastError    string             `bson:"last_error" json:"last_error,omitempty"`
+	NextAttempt  time.Time          `bson:"next_attempt" json:"next_attempt"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// webhookPayload is the json body sent to the subscribers. the subscribers are external systems, so the
+// payload only references the booking or visit instead of containing the data of employees and guests
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Area      string      `json:"area,omitempty"`
+	Date      string      `json:"date,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookBooking is the part of a booking sent to webhooks
+type webhookBooking struct {
+	ID   string `json:"id"`
+	Area string `json:"area"`
+	Date string `json:"date"`
+}
+
+// webhookVisit is the part of a visit sent to webhooks
+type webhookVisit struct {
+	ID               primitive.ObjectID  `json:"id"`
+	GroupID          *primitive.ObjectID `json:"group_id,omitempty"`
+	Site             string              `json:"site"`
+	Date             string              `json:"date"`
+	EndDate          string              `json:"end_date"`
+	InvitationStatus string              `json:"invitation_status"`
+	CheckedInAt      *time.Time          `json:"checked_in_at"`
+	CheckedOutAt     *time.Time          `json:"checked_out_at"`
+}
+
+// newWebhookPayload creates the payload of the event for the delivery with the id
+func newWebhookPayload(id string, e Event) webhookPayload {
+	p := webhookPayload{ID: id, Type: e.Type, CreatedAt: e.CreatedAt, Area: e.Area, Date: e.Date}
+	switch d := e.Data.(type) {
+	case *Booking:
+		p.Data = webhookBooking{ID: d.ID, Area: d.Area, Date: d.Date}
+	case Booking:
+		p.Data = webhookBooking{ID: d.ID, Area: d.Area, Date: d.Date}
+	case *Visit:
+		p.Data = newWebhookVisit(*d)
+	case Visit:
+		p.Data = newWebhookVisit(d)
+	}
+	return p
+}
+
+func newWebhookVisit(v Visit) webhookVisit {
+	return webhookVisit{
+		ID:               v.ID,
+		GroupID:          v.GroupID,
+		Site:             v.Site,
+		Date:             v.Date,
+		EndDate:          v.lastDate(),
+		InvitationStatus: v.InvitationStatus,
+		CheckedInAt:      v.CheckedInAt,
+		CheckedOutAt:     v.CheckedOutAt,
+	}
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// runWebhookDispatcher listens on the event bus and creates a delivery for every matching webhook
+func runWebhookDispatcher() {
+	ch := events.subscribe(256)
+	for e := range ch {
+		if !eventTypes[e.Type] {
+			continue
+		}
+		dispatchEvent(e)
+	}
+}
+
+func dispatchEvent(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	f := bson.D{{"active", true}, {"events", e.Type}}
+	cur, err := client.Database("office_checkin").Collection("webhooks").Find(ctx, f)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	var hooks []Webhook
+	if err := cur.All(ctx, &hooks); err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, h := range hooks {
+		// the first attempt is made right away, so the delivery is claimed by this instance from the start
+		d := WebhookDelivery{
+			ID:          primitive.NewObjectID(),
+			WebhookID:   h.ID,
+			Event:       e.Type,
+			Status:      webhookStatusSending,
+			NextAttempt: time.Now(),
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}
+		p, err := json.Marshal(newWebhookPayload(d.ID.Hex(), e))
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		d.Payload = string(p)
+		if _, err := client.Database("office_checkin").Collection("webhook_deliveries").InsertOne(ctx, d); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		go deliverWebhook(h, d)
+	}
+}
+
+// deliverWebhook makes a single attempt to send the delivery to the webhook. failed attempts are retried by
+// the webhook-deliveries task with an exponential backoff until the subscriber answers with a 2xx status code
+// or the maximum number of attempts is reached
+func deliverWebhook(h Webhook, d WebhookDelivery) {
+	code, err := postWebhook(h, d)
+	d.Attempts++
+	d.ResponseCode = code
+	d.UpdatedAt = time.Now()
+	d.LastError = ""
+	if err != nil {
+		d.LastError = err.Error()
+		logrus.WithFields(logrus.Fields{
+			"webhook": h.ID.Hex(), "delivery": d.ID.Hex(), "attempt": d.Attempts,
+		}).Warn(err)
+	}
+	switch {
+	case err == nil:
+		d.Status = webhookStatusOK
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = webhookStatusFailed
+	default:
+		d.Status = webhookStatusQueued
+		d.NextAttempt = d.UpdatedAt.Add(webhookRetryDelay * time.Duration(1<<uint(d.Attempts-1)))
+	}
+	updateDelivery(d)
+}
+
+// retryWebhookDeliveries sends all deliveries whose next attempt is due. the deliveries are stored, so the
+// retries survive restarts of the service
+func retryWebhookDeliveries() error {
+	hooks := make(map[primitive.ObjectID]*Webhook)
+	for {
+		d, ok, err := claimWebhookDelivery()
+		if err != nil || !ok {
+			return err
+		}
+		h, cached := hooks[d.WebhookID]
+		if !cached {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			var w Webhook
+			err := client.Database("office_checkin").Collection("webhooks").FindOne(ctx, bson.D{{"_id", d.WebhookID}, {"active", true}}).Decode(&w)
+			cancel()
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			if err == nil {
+				h = &w
+			}
+			hooks[d.WebhookID] = h
+		}
+		if h == nil {
+			d.Status = webhookStatusFailed
+			d.LastError = "the webhook does not exist anymore"
+			d.UpdatedAt = time.Now()
+			updateDelivery(d)
+			continue
+		}
+		deliverWebhook(*h, d)
+	}
+}
+
+// claimWebhookDelivery marks a single due delivery as sending, so it is not sent twice
+func claimWebhookDelivery() (WebhookDelivery, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	now := time.Now()
+	f := bson.M{"$or": bson.A{
+		bson.M{"status": webhookStatusQueued, "next_attempt": bson.M{"$lte": now}},
+		bson.M{"status": webhookStatusSending, "updated_at": bson.M{"$lte": now.Add(-webhookSendingTimeout)}},
+	}}
+	update := bson.M{"$set": bson.M{"status": webhookStatusSending, "updated_at": now}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{"next_attempt", 1}}).SetReturnDocument(options.After)
+	var d WebhookDelivery
+	err := client.Database("office_checkin").Collection("webhook_deliveries").FindOneAndUpdate(ctx, f, update, opts).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return d, false, nil
+	}
+	return d, err == nil, err
+}
+
+func postWebhook(h Webhook, d WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.Hex())
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(h.Secret, []byte(d.Payload)))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// signWebhookPayload creates the hex encoded HMAC-SHA256 of the payload, so subscribers can verify the sender
+func signWebhookPayload(secret string, payload []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(payload)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func updateDelivery(d WebhookDelivery) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err := client.Database("office_checkin").Collection("webhook_deliveries").ReplaceOne(ctx, bson.D{{"_id", d.ID}}, d)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func getWebhooks(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	cur, err := client.Database("office_checkin").Collection("webhooks").Find(ctx, bson.D{})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	hooks := []Webhook{}
+	if err := cur.All(ctx, &hooks); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	// the secret is only shown once when creating the webhook
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+func addWebhook(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	var h Webhook
+	if err := c.BindJSON(&h); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"body malformed"},
+		})
+		return
+	}
+	errs := []string{}
+	if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, "url must be a valid http or https url")
+	}
+	if len(h.Events) == 0 {
+		errs = append(errs, "you must subscribe to at least 1 event")
+	}
+	for _, e := range h.Events {
+		if !eventTypes[e] {
+			errs = append(errs, "unknown event "+e)
+		}
+	}
+	if len(errs) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+	if h.Secret == "" {
+		s, err := randomToken(32)
+		if err != nil {
+			logrus.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+			return
+		}
+		h.Secret = s
+	}
+	h.ID = primitive.NewObjectID()
+	h.Active = true
+	h.CreatedBy = c.GetString("userMail")
+	h.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := client.Database("office_checkin").Collection("webhooks").InsertOne(ctx, h); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+func deleteWebhook(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"webhook id malformed"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	dr, err := client.Database("office_checkin").Collection("webhooks").DeleteOne(ctx, bson.D{{"_id", oid}})
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		DeletedItems int64 `json:"deleted_items"`
+	}{
+		DeletedItems: dr.DeletedCount,
+	})
+}
+
+func getWebhookDeliveries(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"webhook id malformed"},
+		})
+		return
+	}
+	f := bson.D{{"webhook_id", oid}}
+	if s := c.Query("status"); s != "" {
+		f = append(f, bson.E{"status", s})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}}).SetLimit(200)
+	cur, err := client.Database("office_checkin").Collection("webhook_deliveries").Find(ctx, f, opts)
+	if err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	deliveries := []WebhookDelivery{}
+	if err := cur.All(ctx, &deliveries); err != nil {
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func redeliverWebhook(c *gin.Context) {
+	if !c.GetBool("isAdmin") {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Code:   http.StatusBadRequest,
+			Errors: []string{"delivery id malformed"},
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var d WebhookDelivery
+	err = client.Database("office_checkin").Collection("webhook_deliveries").FindOne(ctx, bson.D{{"_id", oid}}).Decode(&d)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the delivery could not be found"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	var h Webhook
+	err = client.Database("office_checkin").Collection("webhooks").FindOne(ctx, bson.D{{"_id", d.WebhookID}}).Decode(&h)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+				Code:   http.StatusNotFound,
+				Errors: []string{"the webhook of the delivery does not exist anymore"},
+			})
+			return
+		}
+		logrus.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorInternalError)
+		return
+	}
+	d.Status = webhookStatusSending
+	d.Attempts = 0
+	d.NextAttempt = time.Now()
+	d.UpdatedAt = time.Now()
+	updateDelivery(d)
+	go deliverWebhook(h, d)
+	c.JSON(http.StatusAccepted, SuccessResponse{
+		Code:    http.StatusAccepted,
+		Message: "delivery has been queued",
+	})
+}